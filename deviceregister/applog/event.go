@@ -0,0 +1,77 @@
+// Package applog 上报已注册设备的行为事件（app_log）。
+//
+// 事件按数量和等待时间攒批，请求体使用与 device_register 相同的 header 信封，
+// 并在 header 中加上注册得到的 device_id、install_id 和 bd_did：
+//
+//	{"header": {...}, "events": [{"event": "click", "params": {...}, "local_time_ms": 1600000000000}]}
+//
+// 上报失败按 deviceregister.RetryPolicy 重试，Close 时发送所有未上报的事件；
+// 配置 WithSpool 后网络不可用时的批次写入磁盘队列，恢复后重新上报。
+package applog
+
+import (
+	"do_some_fxxking_test/deviceregister"
+	"errors"
+	"time"
+)
+
+// Event 是一个行为事件
+type Event struct {
+	Name   string
+	Params map[string]interface{}
+	// Time 是事件发生的时间，为零值时使用 Track 的调用时间
+	Time time.Time
+}
+
+// Device 是已注册的设备，事件都归属于它
+type Device struct {
+	deviceregister.DeviceRegister
+	// UDID 是注册时发送的 vendor_id/openudid，不能为空；
+	// 注册使用 WithDeterministicUDID 时可以用 deviceregister.DeriveUDID 重新计算
+	UDID string
+	// Response 是注册结果，不能为 nil
+	Response *deviceregister.Response
+}
+
+// wireEvent 是事件在请求体中的格式
+type wireEvent struct {
+	Event       string                 `json:"event"`
+	Params      map[string]interface{} `json:"params,omitempty"`
+	LocalTimeMs int64                  `json:"local_time_ms"`
+}
+
+func (e Event) wire() wireEvent {
+	return wireEvent{
+		Event:       e.Name,
+		Params:      e.Params,
+		LocalTimeMs: e.Time.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// header 返回 Device 的 header 信封，每次上报都在它的副本上追加 events
+func (d Device) header() (map[string]interface{}, error) {
+	if d.Response == nil || d.Response.BdDid == "" && d.Response.DeviceId == 0 {
+		return nil, errors.New("applog: device is not registered")
+	}
+	if d.UDID == "" {
+		return nil, errors.New("applog: device udid must not be empty")
+	}
+
+	envelope, err := d.Envelope(d.UDID)
+	if err != nil {
+		return nil, err
+	}
+
+	h := envelope["header"].(map[string]interface{})
+	if d.Response.DeviceId != 0 {
+		h["device_id"] = d.Response.DeviceId
+	}
+	if d.Response.InstallId != 0 {
+		h["install_id"] = d.Response.InstallId
+	}
+	if d.Response.BdDid != "" {
+		h["bd_did"] = d.Response.BdDid
+	}
+
+	return h, nil
+}
@@ -0,0 +1,486 @@
+package applog
+
+import (
+	"bytes"
+	"code.byted.org/gopkg/logs"
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/signing"
+	"do_some_fxxking_test/deviceregister/spool"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultEndpoint  = "http://10.225.130.116/service/2/app_log/"
+	DefaultMaxEvents = 100
+	DefaultMaxAge    = time.Second * 5
+	DefaultQueueSize = 10000
+
+	// bodyExcerptLimit 是错误中保留的响应体最大字节数
+	bodyExcerptLimit = 512
+)
+
+// Track 和 Flush 返回的错误
+var (
+	ErrClosed    = errors.New("applog: uploader is closed")
+	ErrQueueFull = errors.New("applog: queue is full")
+)
+
+// Uploader 攒批上报一个设备的事件，可以被多个 goroutine 共用
+type Uploader struct {
+	endpoint    string
+	host        string
+	timeout     time.Duration
+	httpClient  *http.Client
+	retry       deviceregister.RetryPolicy
+	credentials *signing.Credentials
+	maxEvents   int
+	maxAge      time.Duration
+	queueSize   int
+	spool       *spool.Queue
+
+	appId  uint32
+	header map[string]interface{}
+
+	mu      sync.RWMutex
+	closed  bool
+	events  chan Event
+	flushes chan chan error
+	done    chan struct{}
+	// ctx 在 Close 超时后取消，中断正在进行的上报
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stats Stats
+}
+
+// Stats 是 Uploader 启动以来的事件计数
+type Stats struct {
+	// Tracked 是进入队列的事件数
+	Tracked int64
+	// Dropped 是队列已满被丢弃的事件数
+	Dropped int64
+	// Uploaded 是上报成功的事件数
+	Uploaded int64
+	// Failed 是重试用完仍上报失败的事件数
+	Failed int64
+	// Spooled 是因为网络不可用写入 spool 的事件数
+	Spooled int64
+	// Replayed 是从 spool 中取出并上报成功的批次数
+	Replayed int64
+}
+
+type Option func(u *Uploader)
+
+// WithEndpoint 设置 app_log 的完整地址
+func WithEndpoint(endpoint string) Option {
+	return func(u *Uploader) {
+		u.endpoint = endpoint
+	}
+}
+
+// WithHost 设置请求的 Host 头，为空时使用 endpoint 中的 host
+func WithHost(host string) Option {
+	return func(u *Uploader) {
+		u.host = host
+	}
+}
+
+// WithTimeout 设置单次请求的超时时间
+func WithTimeout(timeout time.Duration) Option {
+	return func(u *Uploader) {
+		u.timeout = timeout
+	}
+}
+
+// WithHTTPClient 使用调用方提供的 http.Client，此时 WithTimeout 不生效
+func WithHTTPClient(hc *http.Client) Option {
+	return func(u *Uploader) {
+		u.httpClient = hc
+	}
+}
+
+// WithRetryPolicy 设置每一批的重试策略，与注册使用相同的规则
+func WithRetryPolicy(p deviceregister.RetryPolicy) Option {
+	return func(u *Uploader) {
+		u.retry = p
+	}
+}
+
+// WithCredentials 设置 app key 和 secret，按 signing 包的约定签名
+func WithCredentials(appKey, appSecret string) Option {
+	return func(u *Uploader) {
+		u.credentials = &signing.Credentials{AppKey: appKey, AppSecret: appSecret}
+	}
+}
+
+// WithBatch 设置攒批条件：达到 maxEvents 个事件，或第一个事件等待了 maxAge，就发送这一批
+func WithBatch(maxEvents int, maxAge time.Duration) Option {
+	return func(u *Uploader) {
+		u.maxEvents = maxEvents
+		u.maxAge = maxAge
+	}
+}
+
+// WithQueueSize 设置等待上报的事件数上限，超过时 Track 返回 ErrQueueFull
+func WithQueueSize(n int) Option {
+	return func(u *Uploader) {
+		u.queueSize = n
+	}
+}
+
+// WithSpool 在重试用完仍然因为网络错误、5xx 或 429 失败时，把整批请求体写入 q，
+// 之后每隔 maxAge 和每次上报成功后按顺序重新上报。
+// 请求体中已经包含 header，q 可以在同一个 app 的多个 Uploader 之间共用。
+func WithSpool(q *spool.Queue) Option {
+	return func(u *Uploader) {
+		u.spool = q
+	}
+}
+
+// NewUploader 为 dev 创建 Uploader 并启动后台上报，使用完必须调用 Close
+func NewUploader(dev Device, opts ...Option) (*Uploader, error) {
+	u := &Uploader{
+		endpoint:  DefaultEndpoint,
+		host:      deviceregister.DefaultHost,
+		timeout:   deviceregister.DefaultTimeout,
+		retry:     deviceregister.DefaultRetryPolicy(),
+		maxEvents: DefaultMaxEvents,
+		maxAge:    DefaultMaxAge,
+		queueSize: DefaultQueueSize,
+	}
+	for _, opt := range opts {
+		opt(u)
+	}
+
+	if u.endpoint == "" {
+		return nil, errors.New("applog: endpoint must not be empty")
+	}
+	if u.maxEvents < 1 || u.maxAge <= 0 {
+		return nil, fmt.Errorf("applog: invalid batch of %d events and %v", u.maxEvents, u.maxAge)
+	}
+	if u.queueSize < 1 {
+		return nil, fmt.Errorf("applog: queue size must be positive, got %d", u.queueSize)
+	}
+	if err := u.retry.Validate(); err != nil {
+		return nil, err
+	}
+	if u.credentials != nil {
+		if err := u.credentials.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	header, err := dev.header()
+	if err != nil {
+		return nil, err
+	}
+	if u.httpClient == nil {
+		u.httpClient = &http.Client{Timeout: u.timeout}
+	}
+
+	u.appId = dev.AppId
+	u.header = header
+	u.events = make(chan Event, u.queueSize)
+	u.flushes = make(chan chan error)
+	u.done = make(chan struct{})
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+	go u.loop()
+
+	return u, nil
+}
+
+// Track 把事件放入队列后立即返回，不等待上报
+func (u *Uploader) Track(e Event) error {
+	if e.Name == "" {
+		return errors.New("applog: event name must not be empty")
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// 提前发现无法序列化的参数，避免整批上报失败
+	if _, err := json.Marshal(e.Params); err != nil {
+		return fmt.Errorf("applog: invalid params of event %q: %v", e.Name, err)
+	}
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if u.closed {
+		return ErrClosed
+	}
+
+	select {
+	case u.events <- e:
+		atomic.AddInt64(&u.stats.Tracked, 1)
+		return nil
+	default:
+		atomic.AddInt64(&u.stats.Dropped, 1)
+		return ErrQueueFull
+	}
+}
+
+// Flush 立即上报队列中的所有事件，返回其中最后一个失败批次的错误
+func (u *Uploader) Flush(ctx context.Context) error {
+	u.mu.RLock()
+	closed := u.closed
+	u.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	result := make(chan error, 1)
+	select {
+	case u.flushes <- result:
+	case <-u.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close 停止接收事件并上报剩余的事件，ctx 结束时放弃还没有上报的事件
+func (u *Uploader) Close(ctx context.Context) error {
+	u.mu.Lock()
+	if !u.closed {
+		u.closed = true
+		close(u.events)
+	}
+	u.mu.Unlock()
+
+	select {
+	case <-u.done:
+		return nil
+	case <-ctx.Done():
+		u.cancel()
+		<-u.done
+		return ctx.Err()
+	}
+}
+
+// Stats 返回当前的计数
+func (u *Uploader) Stats() Stats {
+	return Stats{
+		Tracked:  atomic.LoadInt64(&u.stats.Tracked),
+		Dropped:  atomic.LoadInt64(&u.stats.Dropped),
+		Uploaded: atomic.LoadInt64(&u.stats.Uploaded),
+		Failed:   atomic.LoadInt64(&u.stats.Failed),
+		Spooled:  atomic.LoadInt64(&u.stats.Spooled),
+		Replayed: atomic.LoadInt64(&u.stats.Replayed),
+	}
+}
+
+// loop 是唯一的上报协程，同一时间最多只有一个批次在上报，事件按 Track 的顺序发送
+func (u *Uploader) loop() {
+	defer close(u.done)
+	defer u.cancel()
+
+	var (
+		batch []Event
+		timer *time.Timer
+		aged  <-chan time.Time
+		// replay 定期重新上报 spool 中的批次，没有配置 spool 时为 nil
+		replay <-chan time.Time
+	)
+	if u.spool != nil {
+		ticker := time.NewTicker(u.maxAge)
+		defer ticker.Stop()
+		replay = ticker.C
+	}
+	send := func() error {
+		if timer != nil {
+			timer.Stop()
+			timer, aged = nil, nil
+		}
+		err := u.upload(batch)
+		batch = nil
+		return err
+	}
+
+	for {
+		select {
+		case e, ok := <-u.events:
+			if !ok {
+				if len(batch) > 0 {
+					send()
+				}
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) == 1 {
+				timer = time.NewTimer(u.maxAge)
+				aged = timer.C
+			}
+			if len(batch) >= u.maxEvents {
+				send()
+			}
+
+		case <-aged:
+			send()
+
+		case <-replay:
+			u.replay()
+
+		case result := <-u.flushes:
+			var err error
+			// 带上已经在队列中的事件，保证 Flush 之前 Track 的事件都已上报
+			for n := len(u.events); n > 0; n-- {
+				batch = append(batch, <-u.events)
+				if len(batch) >= u.maxEvents {
+					if e := send(); e != nil {
+						err = e
+					}
+				}
+			}
+			if len(batch) > 0 {
+				if e := send(); e != nil {
+					err = e
+				}
+			}
+			result <- err
+		}
+	}
+}
+
+// upload 发送一批事件，失败时按 RetryPolicy 重试
+func (u *Uploader) upload(batch []Event) error {
+	events := make([]wireEvent, len(batch))
+	for i, e := range batch {
+		events[i] = e.wire()
+	}
+	body, err := json.Marshal(map[string]interface{}{"header": u.header, "events": events})
+	if err != nil {
+		return u.failed(batch, err)
+	}
+
+	err = u.postWithRetry(body)
+	if err == nil {
+		atomic.AddInt64(&u.stats.Uploaded, int64(len(batch)))
+		logs.Debug("applog: uploaded %d events", len(batch))
+		u.replay()
+		return nil
+	}
+	// Close 超时中断的批次也写入 spool，下次启动后再上报
+	if u.spool != nil && (deviceregister.IsRetryable(err) || u.ctx.Err() != nil) {
+		serr := u.spool.Put(body)
+		if serr == nil {
+			atomic.AddInt64(&u.stats.Spooled, int64(len(batch)))
+			logs.Warn("applog: spooled %d events after upload failed: %v", len(batch), err)
+			return nil
+		}
+		logs.Error("applog: spool %d events: %v", len(batch), serr)
+	}
+	return u.failed(batch, err)
+}
+
+// replay 按顺序重新上报 spool 中的批次，遇到可重试的失败就停下，等下一次再试。
+// Close 超时中断的批次放回 spool，不能当作不可重试的失败丢弃。
+func (u *Uploader) replay() {
+	if u.spool == nil {
+		return
+	}
+
+	for u.ctx.Err() == nil {
+		item, ok, err := u.spool.TryGet()
+		if err != nil || !ok {
+			return
+		}
+
+		err = u.post(item.Data)
+		if err != nil && (deviceregister.IsRetryable(err) || u.ctx.Err() != nil) {
+			u.spool.Nack(item.ID)
+			return
+		}
+		if err != nil {
+			logs.Error("applog: drop spooled batch %d: %v", item.ID, err)
+		} else {
+			atomic.AddInt64(&u.stats.Replayed, 1)
+		}
+		u.spool.Ack(item.ID)
+	}
+}
+
+// postWithRetry 按 RetryPolicy 发送请求体，ctx 取消时返回 ctx.Err()
+func (u *Uploader) postWithRetry(body []byte) error {
+	for attempt := 1; ; attempt++ {
+		err := u.post(body)
+		if err == nil {
+			return nil
+		}
+		if attempt >= u.retry.Attempts() || u.ctx.Err() != nil || !deviceregister.IsRetryable(err) {
+			return err
+		}
+
+		delay, ok := u.retry.RetryDelay(attempt, err)
+		if !ok {
+			logs.Warn("applog: upload attempt %d failed, Retry-After exceeds the max delay: %v", attempt, err)
+			return err
+		}
+		logs.Warn("applog: upload attempt %d failed, retry after %v: %v", attempt, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-u.ctx.Done():
+			timer.Stop()
+			return u.ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (u *Uploader) failed(batch []Event, err error) error {
+	atomic.AddInt64(&u.stats.Failed, int64(len(batch)))
+	logs.Error("applog: upload %d events failed: %v", len(batch), err)
+	return err
+}
+
+// post 发起一次上报请求，错误类型与注册相同，可以用 deviceregister.KindOf 分类
+func (u *Uploader) post(body []byte) error {
+	req, err := http.NewRequestWithContext(u.ctx, "POST", u.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", deviceregister.UserAgent)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("app_id", strconv.FormatUint(uint64(u.appId), 10))
+	if u.host != "" {
+		req.Host = u.host
+	}
+	if u.credentials != nil {
+		signing.Sign(req, body, *u.credentials, time.Now())
+	}
+
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return &deviceregister.TransportError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, bodyExcerptLimit))
+	if err != nil {
+		return &deviceregister.TransportError{Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &deviceregister.StatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: deviceregister.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			Body:       respBody,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package applog_test
+
+import (
+	"bytes"
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/applog"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"do_some_fxxking_test/deviceregister/signing"
+	"do_some_fxxking_test/deviceregister/spool"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const testUDID = "D931B70D-87A9-5BA6-8E07-A87D7734D880"
+
+func testDevice() applog.Device {
+	return applog.Device{
+		DeviceRegister: deviceregister.DeviceRegister{
+			UserUniqueId: "276095447832965",
+			AppId:        10000012,
+			Os:           "ios",
+			Profile: &deviceregister.Profile{
+				DeviceModel: "iPhone12,1",
+				OsVersion:   "14.2",
+				AppVersion:  "1.0.0",
+			},
+		},
+		UDID:     testUDID,
+		Response: &deviceregister.Response{DeviceId: 4256394634101069489, InstallId: 1308745862428913748, BdDid: "3BE02F3CA8FD33B7"},
+	}
+}
+
+func newUploader(t *testing.T, url string, opts ...applog.Option) *applog.Uploader {
+	t.Helper()
+
+	opts = append([]applog.Option{
+		applog.WithEndpoint(url + mockserver.AppLogPath),
+		applog.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}),
+	}, opts...)
+	u, err := applog.NewUploader(testDevice(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { u.Close(context.Background()) })
+	return u
+}
+
+func track(t *testing.T, u *applog.Uploader, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		if err := u.Track(applog.Event{Name: name, Params: map[string]interface{}{"n": name}}); err != nil {
+			t.Fatalf("Track(%s): %v", name, err)
+		}
+	}
+}
+
+func eventNames(events []mockserver.Event) []string {
+	names := make([]string, 0, len(events))
+	for _, e := range events {
+		names = append(names, e.Event)
+	}
+	return names
+}
+
+func TestUploaderBatches(t *testing.T) {
+	c, ts := mockserver.StartCollector()
+	defer ts.Close()
+
+	u := newUploader(t, ts.URL, applog.WithBatch(2, time.Hour))
+	track(t, u, "e1", "e2", "e3", "e4", "e5")
+	if err := u.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	batches := c.Batches()
+	var sizes []int
+	for _, b := range batches {
+		sizes = append(sizes, len(b.Events))
+	}
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Errorf("batch sizes = %v, want [2 2 1]", sizes)
+	}
+	if got := eventNames(c.Events()); len(got) != 5 || got[0] != "e1" || got[4] != "e5" {
+		t.Errorf("events = %v, want e1..e5 in order", got)
+	}
+
+	// Collector 把 header 解析为 interface{}，数字是 float64
+	h := batches[0].Header
+	tests := []struct {
+		field string
+		want  interface{}
+	}{
+		{"vendor_id", testUDID},
+		{"bd_did", "3BE02F3CA8FD33B7"},
+		{"device_id", float64(4256394634101069489)},
+		{"install_id", float64(1308745862428913748)},
+		{"user_unique_id", "276095447832965"},
+	}
+	for _, tt := range tests {
+		if got := h[tt.field]; got != tt.want {
+			t.Errorf("header %s = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+	if s := u.Stats(); s.Tracked != 5 || s.Uploaded != 5 || s.Failed != 0 {
+		t.Errorf("Stats = %+v, want 5 tracked and uploaded", s)
+	}
+}
+
+func TestUploaderMaxAge(t *testing.T) {
+	c, ts := mockserver.StartCollector()
+	defer ts.Close()
+
+	u := newUploader(t, ts.URL, applog.WithBatch(100, 20*time.Millisecond))
+	track(t, u, "e1")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.Batches()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := eventNames(c.Events()); len(got) != 1 {
+		t.Errorf("events = %v, want e1 uploaded after max age", got)
+	}
+}
+
+func TestUploaderFaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		faults   []mockserver.Fault
+		status   int
+		requests int
+		uploaded int64
+		failed   int64
+	}{
+		{"ok", nil, 0, 1, 1, 0},
+		{"retry", []mockserver.Fault{{Status: http.StatusServiceUnavailable}}, 0, 2, 1, 0},
+		{"retries exhausted", []mockserver.Fault{{Status: http.StatusBadGateway}, {Status: http.StatusBadGateway}}, http.StatusBadGateway, 2, 0, 1},
+		{"not retryable", []mockserver.Fault{{Status: http.StatusBadRequest}}, http.StatusBadRequest, 1, 0, 1},
+		{"retry after too long", []mockserver.Fault{{Status: http.StatusServiceUnavailable, RetryAfter: "86400"}}, http.StatusServiceUnavailable, 1, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, ts := mockserver.StartCollector()
+			defer ts.Close()
+			c.Script(tt.faults...)
+
+			u := newUploader(t, ts.URL)
+			track(t, u, "e1")
+			err := u.Flush(context.Background())
+
+			var se *deviceregister.StatusError
+			if tt.status == 0 && err != nil || tt.status != 0 && (!errors.As(err, &se) || se.StatusCode != tt.status) {
+				t.Errorf("Flush error = %v, want status %d", err, tt.status)
+			}
+			if n := c.Requests(); n != tt.requests {
+				t.Errorf("collector got %d requests, want %d", n, tt.requests)
+			}
+			if s := u.Stats(); s.Uploaded != tt.uploaded || s.Failed != tt.failed {
+				t.Errorf("Stats = %+v, want %d uploaded and %d failed", s, tt.uploaded, tt.failed)
+			}
+		})
+	}
+}
+
+func TestUploaderCloseSendsPending(t *testing.T) {
+	c, ts := mockserver.StartCollector()
+	defer ts.Close()
+
+	u := newUploader(t, ts.URL, applog.WithBatch(100, time.Hour))
+	track(t, u, "e1", "e2")
+	if err := u.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := eventNames(c.Events()); len(got) != 2 {
+		t.Errorf("events = %v, want both events sent on Close", got)
+	}
+	if err := u.Track(applog.Event{Name: "late"}); err != applog.ErrClosed {
+		t.Errorf("Track after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestUploaderSigning(t *testing.T) {
+	c, ts := mockserver.StartCollector()
+	defer ts.Close()
+	c.Verifier = signing.NewVerifier(signing.Credentials{AppKey: "key", AppSecret: "secret"})
+
+	u := newUploader(t, ts.URL, applog.WithCredentials("key", "secret"))
+	track(t, u, "e1")
+	if err := u.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush with credentials: %v", err)
+	}
+
+	unsigned := newUploader(t, ts.URL)
+	track(t, unsigned, "e2")
+	var se *deviceregister.StatusError
+	if err := unsigned.Flush(context.Background()); !errors.As(err, &se) || se.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Flush without credentials = %v, want 401", err)
+	}
+}
+
+func TestUploaderSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "applog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := spool.Open(dir, spool.Options{NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	c, ts := mockserver.StartCollector()
+	defer ts.Close()
+	c.Script(mockserver.Fault{Status: http.StatusServiceUnavailable})
+
+	u := newUploader(t, ts.URL,
+		applog.WithSpool(q),
+		applog.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 1}))
+	track(t, u, "e1")
+	if err := u.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush with spool: %v", err)
+	}
+	if s := u.Stats(); s.Spooled != 1 || q.Stats().Pending != 1 {
+		t.Fatalf("Stats = %+v, spool %+v, want the batch spooled", s, q.Stats())
+	}
+
+	// 下一次上报成功后重新上报 spool 中的批次
+	track(t, u, "e2")
+	if err := u.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got := eventNames(c.Events()); len(got) != 2 || got[0] != "e2" || got[1] != "e1" {
+		t.Errorf("events = %v, want e2 then the replayed e1", got)
+	}
+	if s := u.Stats(); s.Replayed != 1 || q.Stats().Pending != 0 {
+		t.Errorf("Stats = %+v, spool %+v, want the batch replayed", s, q.Stats())
+	}
+}
+
+func TestUploaderCloseKeepsReplayingBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "applog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := spool.Open(dir, spool.Options{NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Put([]byte(`{"header":{},"events":[{"event":"e1"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := mockserver.NewCollector()
+	c.Script(mockserver.Fault{Latency: 10 * time.Second})
+	arrived := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 先读完请求体，客户端断开时服务端才能取消 r.Context()
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+		c.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	u := newUploader(t, ts.URL, applog.WithSpool(q), applog.WithBatch(100, 10*time.Millisecond))
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("spooled batch was not replayed")
+	}
+
+	// replay 进行中时 Close 超时，被中断的批次必须留在 spool 中
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := u.Close(ctx); err != context.Canceled {
+		t.Errorf("Close = %v, want context.Canceled", err)
+	}
+	if s := q.Stats(); s.Pending != 1 || s.Acked != 0 {
+		t.Errorf("spool %+v, want the interrupted batch still pending", s)
+	}
+	if s := u.Stats(); s.Replayed != 0 {
+		t.Errorf("Stats = %+v, want nothing replayed", s)
+	}
+}
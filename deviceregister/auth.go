@@ -0,0 +1,38 @@
+package deviceregister
+
+import (
+	"do_some_fxxking_test/deviceregister/signing"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UserAgent 是私有化 SDK 约定的 User-Agent
+const UserAgent = "Data Creator/2.0.0 (OnPremise)"
+
+// WithCredentials 设置 app key 和 secret，每次请求都会按 signing 包的约定签名。
+// 较新的私有化部署要求签名，旧部署会忽略签名请求头。
+func WithCredentials(appKey, appSecret string) Option {
+	return func(c *Client) {
+		c.credentials = &signing.Credentials{AppKey: appKey, AppSecret: appSecret}
+	}
+}
+
+// setHeaders 设置标准请求头并签名，body 必须是 req 实际发送的请求体
+func (c *Client) setHeaders(req *http.Request, appId uint32, body []byte) {
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("app_id", strconv.FormatUint(uint64(appId), 10))
+	// 显式设置后 http.Transport 不再自动解压，由 readBody 处理并限制大小
+	req.Header.Set("Accept-Encoding", "gzip")
+	if c.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.host != "" {
+		req.Host = c.host
+	}
+
+	if c.credentials != nil {
+		signing.Sign(req, body, *c.credentials, time.Now())
+	}
+}
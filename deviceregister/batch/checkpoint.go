@@ -0,0 +1,179 @@
+package batch
+
+import (
+	"bufio"
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	checkpointSucceeded = "succeeded"
+	checkpointFailed    = "failed"
+)
+
+// Checkpoint 是批量注册的本地日志，每注册完一行就追加一条记录并 fsync。
+// 同一个用户以最后一条记录为准，成功的用户在 resume 时会被跳过，
+// 失败的和日志里没有的（包括中断时正在注册的）用户会重新注册。
+// 这些用户的请求可能已经被服务端处理过，所以 Client 需要使用 WithDeterministicUDID，
+// 否则重新注册会带上新的随机 udid，产生重复的设备。
+type Checkpoint struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]*deviceregister.Response
+
+	// Succeeded 和 Failed 是打开时从日志中恢复的用户数
+	Succeeded int
+	Failed    int
+}
+
+type checkpointRecord struct {
+	Key      string                   `json:"key"`
+	Line     int                      `json:"line"`
+	Status   string                   `json:"status"`
+	Response *deviceregister.Response `json:"response,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// OpenCheckpoint 打开 path 处的日志。
+// resume 为 false 时日志必须不存在，避免误把上一次的进度覆盖掉；
+// resume 为 true 时加载已有记录，文件不存在则新建。
+func OpenCheckpoint(path string, resume bool) (*Checkpoint, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if !resume {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("batch: checkpoint %s already exists, rerun with resume or remove it", path)
+		}
+		return nil, fmt.Errorf("batch: open checkpoint: %v", err)
+	}
+
+	c := &Checkpoint{f: f, done: make(map[string]*deviceregister.Response)}
+	if err := c.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("batch: load checkpoint %s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+// load 读取已有记录。进程在写最后一行时崩溃会留下半行，这里把它截掉
+func (c *Checkpoint) load() error {
+	status := make(map[string]string)
+
+	r := bufio.NewReader(c.f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// 没有换行结尾的最后一行视为未写完，丢弃
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec checkpointRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("corrupt record at offset %d: %v", offset, err)
+		}
+		offset += int64(len(line))
+
+		status[rec.Key] = rec.Status
+		if rec.Status == checkpointSucceeded {
+			c.done[rec.Key] = rec.Response
+		} else {
+			delete(c.done, rec.Key)
+		}
+	}
+
+	if err := c.f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := c.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	for _, s := range status {
+		if s == checkpointSucceeded {
+			c.Succeeded++
+		} else {
+			c.Failed++
+		}
+	}
+
+	return nil
+}
+
+// Completed 返回该行之前成功注册的结果
+func (c *Checkpoint) Completed(row Row) (*deviceregister.Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res, ok := c.done[checkpointKey(row)]
+	return res, ok
+}
+
+// Record 追加一行的结果并落盘。
+// 输入行本身的错误和被取消的请求不记录，resume 时它们仍然是待处理状态。
+func (c *Checkpoint) Record(res Result) error {
+	if res.Skipped {
+		return nil
+	}
+	var re *RowError
+	if errors.As(res.Err, &re) || errors.Is(res.Err, context.Canceled) {
+		return nil
+	}
+
+	rec := checkpointRecord{Key: checkpointKey(res.Row), Line: res.Line, Status: checkpointSucceeded, Response: res.Response}
+	if res.Err != nil {
+		rec.Status, rec.Error, rec.Response = checkpointFailed, res.Err.Error(), nil
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.f.Write(b); err != nil {
+		return fmt.Errorf("batch: write checkpoint: %v", err)
+	}
+	if err := c.f.Sync(); err != nil {
+		return fmt.Errorf("batch: sync checkpoint: %v", err)
+	}
+
+	if rec.Status == checkpointSucceeded {
+		c.done[rec.Key] = rec.Response
+	} else {
+		delete(c.done, rec.Key)
+	}
+
+	return nil
+}
+
+func (c *Checkpoint) Close() error {
+	return c.f.Close()
+}
+
+// checkpointKey 与缓存一样使用平台的规范名，ios 和 iOS 是同一个用户
+func checkpointKey(row Row) string {
+	name := row.Os
+	if p, err := deviceregister.LookupPlatform(row.Os); err == nil {
+		name = p.Name
+	}
+	return strconv.FormatUint(uint64(row.AppId), 10) + "/" + name + "/" + row.UserUniqueId
+}
@@ -0,0 +1,173 @@
+package batch
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func checkpointPath(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "checkpoint.jsonl")
+}
+
+func runWithCheckpoint(t *testing.T, path string, resume bool, reg *fakeRegistrar, input string) (*Summary, map[int]Result) {
+	t.Helper()
+
+	cp, err := OpenCheckpoint(path, resume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+
+	w := &recordWriter{}
+	summary, err := (&Runner{Registrar: reg, Workers: 2, Checkpoint: cp}).Run(context.Background(), NewJSONLReader(strings.NewReader(input)), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return summary, byLine(t, w.results)
+}
+
+func TestCheckpointResume(t *testing.T) {
+	path := checkpointPath(t)
+	input := jsonlInput(4)
+
+	// 第一次：1 成功，2 失败，3 在注册时被中断，4 成功
+	first := &fakeRegistrar{fail: map[string]error{
+		"2": &deviceregister.StatusError{StatusCode: http.StatusServiceUnavailable},
+		"3": context.Canceled,
+	}}
+	runWithCheckpoint(t, path, false, first, input)
+
+	cp, err := OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Succeeded != 2 || cp.Failed != 1 {
+		t.Errorf("checkpoint = %d succeeded %d failed, want 2 and 1", cp.Succeeded, cp.Failed)
+	}
+	cp.Close()
+
+	// 第二次：成功的用户跳过，失败的和没有记录的用户重新注册
+	second := &fakeRegistrar{}
+	summary, results := runWithCheckpoint(t, path, true, second, input)
+	for user, want := range map[string]int{"1": 0, "2": 1, "3": 1, "4": 0} {
+		if second.calls[user] != want {
+			t.Errorf("user %s registered %d times on resume, want %d", user, second.calls[user], want)
+		}
+	}
+	if summary.Skipped != 2 || summary.Succeeded != 2 {
+		t.Errorf("summary = %+v, want 2 skipped and 2 succeeded", summary)
+	}
+	if res := results[1]; !res.Skipped || res.Response == nil || res.Response.DeviceId != 1001 {
+		t.Errorf("line 1 = %+v, want the response from the checkpoint", res)
+	}
+
+	// 第三次全部跳过
+	third := &fakeRegistrar{}
+	if summary, _ := runWithCheckpoint(t, path, true, third, input); summary.Skipped != 4 || len(third.calls) != 0 {
+		t.Errorf("summary = %+v, calls = %v, want every row skipped", summary, third.calls)
+	}
+}
+
+func TestCheckpointSamePlatformAlias(t *testing.T) {
+	path := checkpointPath(t)
+	runWithCheckpoint(t, path, false, &fakeRegistrar{}, `{"user_unique_id":"1","app_id":10000012,"os":"ios"}`+"\n")
+
+	reg := &fakeRegistrar{}
+	if summary, _ := runWithCheckpoint(t, path, true, reg, `{"user_unique_id":"1","app_id":10000012,"os":"iOS"}`+"\n"); summary.Skipped != 1 {
+		t.Errorf("summary = %+v, want iOS to match the ios record", summary)
+	}
+}
+
+func TestCheckpointExists(t *testing.T) {
+	path := checkpointPath(t)
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCheckpoint(path, false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("OpenCheckpoint error = %v, want it to refuse overwriting", err)
+	}
+}
+
+func TestCheckpointTruncatesPartialLine(t *testing.T) {
+	path := checkpointPath(t)
+	rec, _ := json.Marshal(checkpointRecord{Key: "10000012/ios/1", Line: 1, Status: checkpointSucceeded, Response: &deviceregister.Response{DeviceId: 1001}})
+	complete := string(rec) + "\n"
+	if err := ioutil.WriteFile(path, []byte(complete+`{"key":"10000012/ios/2","li`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err := OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Succeeded != 1 || cp.Failed != 0 {
+		t.Errorf("checkpoint = %d succeeded %d failed, want 1 and 0", cp.Succeeded, cp.Failed)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != complete {
+		t.Errorf("checkpoint = %q, want the partial line removed", b)
+	}
+
+	// 新记录从截断处开始追加，再次打开时可以完整读出
+	row := Row{Line: 2, DeviceRegister: deviceregister.DeviceRegister{UserUniqueId: "2", AppId: 10000012, Os: "ios"}}
+	if err := cp.Record(Result{Row: row, Response: &deviceregister.Response{DeviceId: 1002}}); err != nil {
+		t.Fatal(err)
+	}
+	cp.Close()
+
+	cp, err = OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatalf("reopen after append: %v", err)
+	}
+	defer cp.Close()
+	if res, ok := cp.Completed(row); !ok || res.DeviceId != 1002 || cp.Succeeded != 2 {
+		t.Errorf("Completed = %+v %v, succeeded %d, want the appended record", res, ok, cp.Succeeded)
+	}
+}
+
+func TestCheckpointCorruptRecord(t *testing.T) {
+	path := checkpointPath(t)
+	if err := ioutil.WriteFile(path, []byte("{not json}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCheckpoint(path, true); err == nil || !strings.Contains(err.Error(), "corrupt record") {
+		t.Errorf("OpenCheckpoint error = %v, want a corrupt record error", err)
+	}
+}
+
+func TestCheckpointSkipsRowErrors(t *testing.T) {
+	path := checkpointPath(t)
+	cp, err := OpenCheckpoint(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+
+	row := Row{Line: 1, DeviceRegister: deviceregister.DeviceRegister{AppId: 10000012, Os: "ios"}}
+	if err := cp.Record(Result{Row: row, Err: &RowError{Line: 1, Err: os.ErrInvalid}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.Record(Result{Row: row, Skipped: true}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 {
+		t.Errorf("checkpoint has %d bytes, want row errors and skipped rows left out", fi.Size())
+	}
+}
@@ -0,0 +1,160 @@
+// Package batch 批量注册 device_id：从 CSV/JSONL 流式读取用户，
+// 用固定数量的 worker 并发注册，并对每一行输出一条结果。
+package batch
+
+import (
+	"bufio"
+	"do_some_fxxking_test/deviceregister"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Row 是输入中的一行，Line 从 1 开始，CSV 的表头不计入
+type Row struct {
+	Line int
+	deviceregister.DeviceRegister
+}
+
+// RowError 表示某一行无法解析，只影响这一行，不会中断整个批次
+type RowError struct {
+	Line int
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error { return e.Err }
+
+// Reader 逐行读取输入，读完返回 io.EOF
+type Reader interface {
+	Next() (Row, error)
+}
+
+// NewReader 根据 format（csv 或 jsonl）创建 Reader
+func NewReader(format string, r io.Reader) (Reader, error) {
+	switch strings.ToLower(format) {
+	case "csv":
+		return NewCSVReader(r)
+	case "jsonl", "json":
+		return NewJSONLReader(r), nil
+	default:
+		return nil, fmt.Errorf("batch: unknown input format %q", format)
+	}
+}
+
+type csvReader struct {
+	r    *csv.Reader
+	cols map[string]int
+	line int
+}
+
+// NewCSVReader 要求第一行是表头，且包含 user_unique_id、app_id、os 三列，列的顺序不限
+func NewCSVReader(r io.Reader) (Reader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("batch: read csv header: %v", err)
+	}
+
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"user_unique_id", "app_id", "os"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("batch: csv header has no %s column", name)
+		}
+	}
+
+	return &csvReader{r: cr, cols: cols}, nil
+}
+
+func (c *csvReader) Next() (Row, error) {
+	record, err := c.r.Read()
+	if err == io.EOF {
+		return Row{}, io.EOF
+	}
+	c.line++
+	if err != nil {
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			return Row{Line: c.line}, &RowError{Line: c.line, Err: err}
+		}
+		return Row{}, err
+	}
+
+	field := func(name string) string {
+		i := c.cols[name]
+		if i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	row := Row{Line: c.line}
+	row.UserUniqueId = field("user_unique_id")
+	row.Os = field("os")
+
+	appId, err := strconv.ParseUint(field("app_id"), 10, 32)
+	if err != nil {
+		return row, &RowError{Line: c.line, Err: fmt.Errorf("invalid app_id: %v", err)}
+	}
+	row.AppId = uint32(appId)
+
+	return row, validateRow(row)
+}
+
+type jsonlReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+// NewJSONLReader 每行一个 JSON 对象，字段与 DeviceRegister 的 json tag 一致，空行会被跳过
+func NewJSONLReader(r io.Reader) Reader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &jsonlReader{s: s}
+}
+
+func (j *jsonlReader) Next() (Row, error) {
+	for j.s.Scan() {
+		j.line++
+		text := strings.TrimSpace(j.s.Text())
+		if text == "" {
+			continue
+		}
+
+		row := Row{Line: j.line}
+		if err := json.Unmarshal([]byte(text), &row.DeviceRegister); err != nil {
+			return row, &RowError{Line: j.line, Err: err}
+		}
+
+		return row, validateRow(row)
+	}
+	if err := j.s.Err(); err != nil {
+		return Row{}, err
+	}
+
+	return Row{}, io.EOF
+}
+
+func validateRow(row Row) error {
+	if row.UserUniqueId == "" {
+		return &RowError{Line: row.Line, Err: errors.New("user_unique_id is empty")}
+	}
+	if row.AppId == 0 {
+		return &RowError{Line: row.Line, Err: errors.New("app_id is empty")}
+	}
+
+	return nil
+}
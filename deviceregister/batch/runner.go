@@ -0,0 +1,173 @@
+package batch
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Runner 并发执行批量注册
+type Runner struct {
+	Registrar deviceregister.Registrar
+	// Workers 是并发数，小于 1 时按 1 处理
+	Workers int
+	// QPS 是所有 worker 共享的请求速率上限，0 表示不限速
+	QPS float64
+	// Checkpoint 不为 nil 时跳过其中已成功的行，并记录本次每一行的结果
+	Checkpoint *Checkpoint
+}
+
+// Run 从 r 读取所有行，注册后写入 w，返回汇总。
+// 单行解析失败或注册失败只记录在结果里；读输入、写结果或写 Checkpoint 失败会中断整个批次。
+func (rn *Runner) Run(ctx context.Context, r Reader, w Writer) (*Summary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := rn.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	limiter := newLimiter(rn.QPS)
+	defer limiter.stop()
+
+	rows := make(chan Row, workers)
+	results := make(chan Result, workers)
+
+	var readErr error
+	go func() {
+		defer close(rows)
+		for {
+			row, err := r.Next()
+			if err == io.EOF {
+				return
+			}
+			var re *RowError
+			if err != nil && !errors.As(err, &re) {
+				readErr = err
+				cancel()
+				return
+			}
+			if re != nil {
+				// 解析失败的行直接产出结果，不占用 worker
+				select {
+				case results <- Result{Row: row, Err: re}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			if rn.Checkpoint != nil {
+				if res, ok := rn.Checkpoint.Completed(row); ok {
+					select {
+					case results <- Result{Row: row, Response: res, Skipped: true}:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+			}
+
+			select {
+			case rows <- row:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range rows {
+				results <- rn.register(ctx, limiter, row)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		// 读协程写完解析失败的行之后才会关闭 rows，所以这里关闭 results 是安全的
+		close(results)
+	}()
+
+	summary := newSummary()
+	var writeErr error
+	for res := range results {
+		summary.add(res)
+		if writeErr != nil {
+			continue
+		}
+		if rn.Checkpoint != nil {
+			if err := rn.Checkpoint.Record(res); err != nil {
+				writeErr = err
+				cancel()
+				continue
+			}
+		}
+		if err := w.Write(res); err != nil {
+			writeErr = err
+			cancel()
+		}
+	}
+	if err := w.Flush(); err != nil && writeErr == nil {
+		writeErr = err
+	}
+
+	summary.finish()
+	if readErr != nil {
+		return summary, readErr
+	}
+	return summary, writeErr
+}
+
+func (rn *Runner) register(ctx context.Context, limiter *limiter, row Row) Result {
+	if err := limiter.wait(ctx); err != nil {
+		return Result{Row: row, Err: err}
+	}
+
+	start := time.Now()
+	res, err := rn.Registrar.Register(ctx, row.DeviceRegister)
+
+	return Result{Row: row, Response: res, Err: err, Latency: time.Since(start)}
+}
+
+// limiter 是所有 worker 共享的固定速率限流器
+type limiter struct {
+	ticker *time.Ticker
+}
+
+func newLimiter(qps float64) *limiter {
+	if qps <= 0 {
+		return &limiter{}
+	}
+
+	interval := time.Duration(float64(time.Second) / qps)
+	if interval <= 0 {
+		interval = 1
+	}
+	return &limiter{ticker: time.NewTicker(interval)}
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	if l.ticker == nil {
+		return ctx.Err()
+	}
+
+	select {
+	case <-l.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) stop() {
+	if l.ticker != nil {
+		l.ticker.Stop()
+	}
+}
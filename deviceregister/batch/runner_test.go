@@ -0,0 +1,245 @@
+package batch
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegistrar 记录每个用户的调用次数和同时进行的请求数，fail 中的用户返回对应的错误
+type fakeRegistrar struct {
+	mu       sync.Mutex
+	calls    map[string]int
+	inflight int
+	max      int
+
+	delay func(dr deviceregister.DeviceRegister) time.Duration
+	fail  map[string]error
+}
+
+func (f *fakeRegistrar) Register(ctx context.Context, dr deviceregister.DeviceRegister) (*deviceregister.Response, error) {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[dr.UserUniqueId]++
+	f.inflight++
+	if f.inflight > f.max {
+		f.max = f.inflight
+	}
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.inflight--
+		f.mu.Unlock()
+	}()
+
+	if f.delay != nil {
+		time.Sleep(f.delay(dr))
+	}
+	if err := f.fail[dr.UserUniqueId]; err != nil {
+		return nil, err
+	}
+	id, _ := strconv.ParseUint(dr.UserUniqueId, 10, 64)
+	return &deviceregister.Response{DeviceId: 1000 + id, BdDid: "did-" + dr.UserUniqueId}, nil
+}
+
+// recordWriter 按写入顺序保存结果
+type recordWriter struct {
+	results []Result
+	flushed bool
+}
+
+func (w *recordWriter) Write(res Result) error {
+	w.results = append(w.results, res)
+	return nil
+}
+
+func (w *recordWriter) Flush() error {
+	w.flushed = true
+	return nil
+}
+
+// byLine 按行号索引结果，同一行出现两次时报错
+func byLine(t *testing.T, results []Result) map[int]Result {
+	t.Helper()
+
+	m := make(map[int]Result, len(results))
+	for _, res := range results {
+		if _, ok := m[res.Line]; ok {
+			t.Errorf("line %d has more than one result", res.Line)
+		}
+		m[res.Line] = res
+	}
+	return m
+}
+
+// jsonlInput 生成 n 行输入，第 i 行的 user_unique_id 是 i
+func jsonlInput(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, `{"user_unique_id":"%d","app_id":10000012,"os":"ios"}`+"\n", i)
+	}
+	return b.String()
+}
+
+func TestRunnerConcurrency(t *testing.T) {
+	const workers, n = 4, 24
+	// 行号越小越慢，结果的顺序与输入不同
+	reg := &fakeRegistrar{delay: func(dr deviceregister.DeviceRegister) time.Duration {
+		id, _ := strconv.Atoi(dr.UserUniqueId)
+		return time.Duration(n-id+1) * time.Millisecond
+	}}
+	w := &recordWriter{}
+	rn := &Runner{Registrar: reg, Workers: workers}
+
+	summary, err := rn.Run(context.Background(), NewJSONLReader(strings.NewReader(jsonlInput(n))), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.flushed {
+		t.Error("writer was not flushed")
+	}
+	if reg.max > workers || reg.max < 2 {
+		t.Errorf("%d requests in flight at most, want 2 to %d", reg.max, workers)
+	}
+	if summary.Total != n || summary.Succeeded != n || summary.Failed != 0 {
+		t.Errorf("summary = %+v, want %d succeeded", summary, n)
+	}
+
+	// 结果按完成顺序输出，但每一条都必须对应自己的输入行
+	results := byLine(t, w.results)
+	for i := 1; i <= n; i++ {
+		res, ok := results[i]
+		if !ok {
+			t.Errorf("line %d has no result", i)
+			continue
+		}
+		if res.UserUniqueId != strconv.Itoa(i) || res.Response == nil || res.Response.DeviceId != uint64(1000+i) {
+			t.Errorf("line %d = user %s response %+v", i, res.UserUniqueId, res.Response)
+		}
+		if reg.calls[res.UserUniqueId] != 1 {
+			t.Errorf("user %s registered %d times, want 1", res.UserUniqueId, reg.calls[res.UserUniqueId])
+		}
+	}
+}
+
+func TestRunnerSingleWorker(t *testing.T) {
+	reg := &fakeRegistrar{}
+	w := &recordWriter{}
+	rn := &Runner{Registrar: reg}
+
+	if _, err := rn.Run(context.Background(), NewJSONLReader(strings.NewReader(jsonlInput(5))), w); err != nil {
+		t.Fatal(err)
+	}
+	if reg.max != 1 {
+		t.Errorf("%d requests in flight at most, want 1", reg.max)
+	}
+	// 只有一个 worker 时结果与输入顺序一致
+	for i, res := range w.results {
+		if res.Line != i+1 {
+			t.Errorf("result %d is line %d", i, res.Line)
+		}
+	}
+}
+
+func TestRunnerRowErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		input  string
+		// bad 是解析失败的行号
+		bad []int
+	}{
+		{
+			name:   "jsonl",
+			format: "jsonl",
+			input: `{"user_unique_id":"1","app_id":10000012,"os":"ios"}
+{"user_unique_id":"2","app_id":
+{"app_id":10000012,"os":"ios"}
+
+{"user_unique_id":"5","app_id":0,"os":"ios"}
+{"user_unique_id":"6","app_id":10000012,"os":"android"}
+`,
+			bad: []int{2, 3, 5},
+		},
+		{
+			name:   "csv",
+			format: "csv",
+			input: `os,app_id,user_unique_id
+ios,10000012,1
+ios,abc,2
+ios,10000012,
+android,10000012,4
+ios,10000012,"5
+`,
+			bad: []int{2, 3, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(tt.format, strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reg := &fakeRegistrar{}
+			w := &recordWriter{}
+			summary, err := (&Runner{Registrar: reg, Workers: 2}).Run(context.Background(), r, w)
+			if err != nil {
+				t.Fatalf("Run: %v, want row errors to stay in the results", err)
+			}
+
+			results := byLine(t, w.results)
+			for _, line := range tt.bad {
+				var re *RowError
+				if res := results[line]; !errors.As(res.Err, &re) || re.Line != line || res.Response != nil {
+					t.Errorf("line %d = %+v, want a RowError", line, res)
+				}
+			}
+			if summary.FailedByKind["invalid_row"] != len(tt.bad) {
+				t.Errorf("invalid_row = %d, want %d", summary.FailedByKind["invalid_row"], len(tt.bad))
+			}
+			// 解析失败的行不会发出请求
+			registered := 0
+			for _, n := range reg.calls {
+				registered += n
+			}
+			if registered != summary.Total-len(tt.bad) {
+				t.Errorf("registered %d rows, want %d", registered, summary.Total-len(tt.bad))
+			}
+		})
+	}
+}
+
+func TestRunnerRegisterError(t *testing.T) {
+	reg := &fakeRegistrar{fail: map[string]error{"2": &deviceregister.StatusError{StatusCode: http.StatusServiceUnavailable}}}
+	w := &recordWriter{}
+
+	summary, err := (&Runner{Registrar: reg, Workers: 2}).Run(context.Background(), NewJSONLReader(strings.NewReader(jsonlInput(3))), w)
+	if err != nil {
+		t.Fatalf("Run: %v, want a failed registration to stay in the results", err)
+	}
+	if res := byLine(t, w.results)[2]; res.Err == nil || res.Response != nil {
+		t.Errorf("line 2 = %+v, want the registration error", res)
+	}
+	if summary.Succeeded != 2 || summary.Failed != 1 || summary.FailedByKind[deviceregister.KindStatus.String()] != 1 {
+		t.Errorf("summary = %+v", summary)
+	}
+}
+
+func TestNewCSVReaderHeader(t *testing.T) {
+	if _, err := NewCSVReader(strings.NewReader("user_unique_id,os\n1,ios\n")); err == nil || !strings.Contains(err.Error(), "app_id") {
+		t.Errorf("NewCSVReader error = %v, want the missing app_id column", err)
+	}
+	if _, err := NewReader("xml", strings.NewReader("")); err == nil {
+		t.Error("NewReader accepted an unknown format")
+	}
+}
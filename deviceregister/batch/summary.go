@@ -0,0 +1,95 @@
+package batch
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Summary 是一个批次的汇总
+type Summary struct {
+	Total     int
+	Succeeded int
+	Failed    int
+	// Skipped 是 Checkpoint 中已经成功、本次没有重新注册的行数
+	Skipped int
+	// FailedByKind 按错误类别统计失败数，类别与结果中的 error_kind 一致
+	FailedByKind map[string]int
+
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+
+	Elapsed time.Duration
+
+	start     time.Time
+	latencies []time.Duration
+}
+
+func newSummary() *Summary {
+	return &Summary{
+		FailedByKind: make(map[string]int),
+		start:        time.Now(),
+	}
+}
+
+func (s *Summary) add(res Result) {
+	s.Total++
+	if res.Skipped {
+		s.Skipped++
+		return
+	}
+	if res.Err != nil {
+		s.Failed++
+		s.FailedByKind[errorKind(res.Err)]++
+	} else {
+		s.Succeeded++
+	}
+
+	// 没有发出请求的行不计入延迟
+	if res.Latency > 0 {
+		s.latencies = append(s.latencies, res.Latency)
+	}
+}
+
+func (s *Summary) finish() {
+	s.Elapsed = time.Since(s.start)
+	if len(s.latencies) == 0 {
+		return
+	}
+
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	s.P50 = percentile(s.latencies, 50)
+	s.P90 = percentile(s.latencies, 90)
+	s.P99 = percentile(s.latencies, 99)
+	s.Max = s.latencies[len(s.latencies)-1]
+	s.latencies = nil
+}
+
+// percentile 使用 nearest-rank 算法，sorted 必须升序且非空
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Print 以人类可读的格式输出汇总
+func (s *Summary) Print(w io.Writer) {
+	fmt.Fprintf(w, "total %d, succeeded %d, failed %d, skipped %d, elapsed %v\n",
+		s.Total, s.Succeeded, s.Failed, s.Skipped, s.Elapsed)
+
+	kinds := make([]string, 0, len(s.FailedByKind))
+	for kind := range s.FailedByKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %s: %d\n", kind, s.FailedByKind[kind])
+	}
+
+	fmt.Fprintf(w, "latency p50 %v, p90 %v, p99 %v, max %v\n", s.P50, s.P90, s.P99, s.Max)
+}
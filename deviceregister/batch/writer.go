@@ -0,0 +1,134 @@
+package batch
+
+import (
+	"do_some_fxxking_test/deviceregister"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Result 是一行输入的注册结果，Err 不为 nil 时 Response 为 nil。
+// Skipped 表示该行在 Checkpoint 中已经成功，Response 取自 Checkpoint。
+type Result struct {
+	Row
+	Response *deviceregister.Response
+	Err      error
+	Latency  time.Duration
+	Skipped  bool
+}
+
+// Writer 输出结果，由 Runner 在单个 goroutine 中调用
+type Writer interface {
+	Write(res Result) error
+	Flush() error
+}
+
+// NewWriter 根据 format（csv 或 jsonl）创建 Writer
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch strings.ToLower(format) {
+	case "csv":
+		return NewCSVWriter(w), nil
+	case "jsonl", "json":
+		return NewJSONLWriter(w), nil
+	default:
+		return nil, fmt.Errorf("batch: unknown output format %q", format)
+	}
+}
+
+var csvHeader = []string{
+	"line", "user_unique_id", "app_id", "os",
+	"device_id", "install_id", "bd_did", "cd", "install_id_str", "new_user", "ssid", "server_time",
+	"error_kind", "error", "latency_ms", "skipped",
+}
+
+type csvWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func NewCSVWriter(w io.Writer) Writer {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) Write(res Result) error {
+	if !c.wroteHeader {
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+		c.wroteHeader = true
+	}
+
+	record := make([]string, 0, len(csvHeader))
+	record = append(record,
+		strconv.Itoa(res.Line), res.UserUniqueId, strconv.FormatUint(uint64(res.AppId), 10), res.Os)
+
+	if r := res.Response; r != nil {
+		record = append(record,
+			strconv.FormatUint(r.DeviceId, 10), strconv.FormatUint(r.InstallId, 10), r.BdDid, r.Cd,
+			r.InstallIdStr, strconv.Itoa(int(r.NewUser)), r.Ssid, strconv.FormatUint(r.ServerTime, 10))
+	} else {
+		record = append(record, "", "", "", "", "", "", "", "")
+	}
+
+	errKind, errMsg := "", ""
+	if res.Err != nil {
+		errKind, errMsg = errorKind(res.Err), res.Err.Error()
+	}
+	record = append(record, errKind, errMsg, strconv.FormatInt(res.Latency.Milliseconds(), 10), strconv.FormatBool(res.Skipped))
+
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func NewJSONLWriter(w io.Writer) Writer {
+	return &jsonlWriter{enc: json.NewEncoder(w)}
+}
+
+type jsonlResult struct {
+	Line int `json:"line"`
+	deviceregister.DeviceRegister
+	*deviceregister.Response
+	ErrorKind string `json:"error_kind,omitempty"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+	Skipped   bool   `json:"skipped,omitempty"`
+}
+
+func (j *jsonlWriter) Write(res Result) error {
+	out := jsonlResult{
+		Line:           res.Line,
+		DeviceRegister: res.DeviceRegister,
+		Response:       res.Response,
+		LatencyMs:      res.Latency.Milliseconds(),
+		Skipped:        res.Skipped,
+	}
+	if res.Err != nil {
+		out.ErrorKind, out.Error = errorKind(res.Err), res.Err.Error()
+	}
+
+	return j.enc.Encode(out)
+}
+
+func (j *jsonlWriter) Flush() error {
+	return nil
+}
+
+// errorKind 在 deviceregister.Kind 的基础上区分出输入行本身的错误
+func errorKind(err error) string {
+	if _, ok := err.(*RowError); ok {
+		return "invalid_row"
+	}
+	return deviceregister.KindOf(err).String()
+}
@@ -0,0 +1,33 @@
+package deviceregister
+
+// Envelope 返回与注册请求相同的 {"header": {...}} 信封，udid 应与注册时使用的标识一致，
+// 上报事件等后续请求在此基础上追加字段
+func (dr DeviceRegister) Envelope(udid string) (map[string]interface{}, error) {
+	p, err := dr.platform()
+	if err != nil {
+		return nil, err
+	}
+
+	return dr.generateBody(p, udid), nil
+}
+
+// generateBody 生成请求体，udid 会填到平台对应的标识字段，如 iOS 的 vendor_id、Android 的 openudid
+func (dr DeviceRegister) generateBody(p Platform, udid string) map[string]interface{} {
+	header := make(map[string]interface{})
+
+	body := make(map[string]interface{}, 0)
+
+	// Profile 先写入，保证后面的固定字段不会被覆盖
+	if dr.Profile != nil {
+		dr.Profile.fill(body)
+	}
+
+	body["aid"] = dr.AppId
+	body["user_unique_id"] = dr.UserUniqueId
+	body["os"] = p.WireOs
+	body[p.IdentifierField] = udid
+
+	header["header"] = body
+
+	return header
+}
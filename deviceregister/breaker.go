@@ -0,0 +1,291 @@
+package deviceregister
+
+import (
+	"code.byted.org/gopkg/logs"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen 表示熔断器处于打开状态，请求没有发出
+var ErrCircuitOpen = errors.New("deviceregister: circuit breaker is open")
+
+// BreakerState 是熔断器的状态
+type BreakerState int
+
+const (
+	// BreakerClosed 正常放行请求，统计失败
+	BreakerClosed BreakerState = iota
+	// BreakerOpen 直接拒绝请求，冷却结束后进入 BreakerHalfOpen
+	BreakerOpen
+	// BreakerHalfOpen 放行少量探测请求，全部成功后关闭，任一失败重新打开
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// BreakerPolicy 控制熔断器何时打开。
+// 只有网络错误和 5xx 计为失败，4xx、响应格式错误等说明服务端是可达的，计为成功。
+type BreakerPolicy struct {
+	// ConsecutiveFailures 是连续失败多少次后打开，为 0 时不按连续失败判断
+	ConsecutiveFailures int
+	// FailureRatio 取值 (0, 1]，Window 内失败比例达到它时打开，为 0 时不按比例判断
+	FailureRatio float64
+	// MinRequests 是按比例判断前 Window 内至少需要的请求数
+	MinRequests int
+	// Window 是统计失败比例的时间窗口
+	Window time.Duration
+	// CoolDown 是打开后拒绝请求的时间
+	CoolDown time.Duration
+	// HalfOpenRequests 是半开状态下的探测请求数，小于 1 时按 1 处理
+	HalfOpenRequests int
+}
+
+func DefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{
+		ConsecutiveFailures: 5,
+		FailureRatio:        0.5,
+		MinRequests:         20,
+		Window:              time.Minute,
+		CoolDown:            time.Second * 30,
+		HalfOpenRequests:    1,
+	}
+}
+
+// WithCircuitBreaker 在每次请求外包一层熔断，默认不启用
+func WithCircuitBreaker(p BreakerPolicy) Option {
+	return func(c *Client) {
+		c.breaker = newBreaker(p)
+	}
+}
+
+func (p BreakerPolicy) validate() error {
+	if p.ConsecutiveFailures < 0 || p.MinRequests < 0 || p.HalfOpenRequests < 0 {
+		return errors.New("deviceregister: breaker counts must not be negative")
+	}
+	if p.FailureRatio < 0 || p.FailureRatio > 1 {
+		return fmt.Errorf("deviceregister: breaker failure ratio must be in [0, 1], got %v", p.FailureRatio)
+	}
+	if p.ConsecutiveFailures == 0 && p.FailureRatio == 0 {
+		return errors.New("deviceregister: breaker needs consecutive failures or failure ratio")
+	}
+	if p.FailureRatio > 0 && p.Window <= 0 {
+		return errors.New("deviceregister: breaker window must be positive when failure ratio is set")
+	}
+	if p.CoolDown <= 0 {
+		return fmt.Errorf("deviceregister: breaker cool down must be positive, got %v", p.CoolDown)
+	}
+
+	return nil
+}
+
+// CircuitOpenError 是熔断器打开时返回的错误，RetryAfter 是距离冷却结束的时间
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrCircuitOpen, e.RetryAfter)
+}
+
+func (e *CircuitOpenError) Is(target error) bool { return target == ErrCircuitOpen }
+
+// transition 记录一次状态变化，由调用方在释放锁之后输出日志和打点
+type transition struct {
+	from, to BreakerState
+}
+
+type breaker struct {
+	policy BreakerPolicy
+
+	mu          sync.Mutex
+	state       BreakerState
+	generation  uint64
+	consecutive int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probes      int
+	probeOk     int
+}
+
+func newBreaker(p BreakerPolicy) *breaker {
+	return &breaker{policy: p}
+}
+
+// allow 判断是否放行一次请求，返回的 generation 需要原样传给 record
+func (b *breaker) allow(now time.Time) (generation uint64, t *transition, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		if wait := b.openedAt.Add(b.policy.CoolDown).Sub(now); wait > 0 {
+			return 0, nil, &CircuitOpenError{RetryAfter: wait}
+		}
+		t = b.setState(BreakerHalfOpen, now)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.halfOpenRequests() {
+			return 0, t, &CircuitOpenError{}
+		}
+		b.probes++
+	}
+
+	return b.generation, t, nil
+}
+
+// record 记录一次请求的结果，状态已经变化过的旧请求会被忽略
+func (b *breaker) record(generation uint64, failed bool, now time.Time) *transition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return nil
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			return b.setState(BreakerOpen, now)
+		}
+		b.probeOk++
+		if b.probeOk >= b.halfOpenRequests() {
+			return b.setState(BreakerClosed, now)
+		}
+	case BreakerClosed:
+		if b.policy.Window > 0 && now.Sub(b.windowStart) >= b.policy.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if !failed {
+			b.consecutive = 0
+			return nil
+		}
+		b.consecutive++
+		b.failures++
+
+		p := b.policy
+		if p.ConsecutiveFailures > 0 && b.consecutive >= p.ConsecutiveFailures {
+			return b.setState(BreakerOpen, now)
+		}
+		if p.FailureRatio > 0 && b.requests >= p.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= p.FailureRatio {
+			return b.setState(BreakerOpen, now)
+		}
+	}
+
+	return nil
+}
+
+// release 归还一个没有结果的探测名额，如调用方取消了请求
+func (b *breaker) release(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation == b.generation && b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// setState 切换状态并清空计数，调用方持有 mu
+func (b *breaker) setState(to BreakerState, now time.Time) *transition {
+	t := &transition{from: b.state, to: to}
+	b.state = to
+	b.generation++
+	b.consecutive, b.requests, b.failures = 0, 0, 0
+	b.probes, b.probeOk = 0, 0
+	b.windowStart = now
+	if to == BreakerOpen {
+		b.openedAt = now
+	}
+
+	return t
+}
+
+func (b *breaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+func (b *breaker) halfOpenRequests() int {
+	if b.policy.HalfOpenRequests < 1 {
+		return 1
+	}
+	return b.policy.HalfOpenRequests
+}
+
+// breakerFailure 判断一次请求的结果是否说明服务不可用
+func breakerFailure(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= http.StatusInternalServerError
+	}
+
+	return errors.Is(err, ErrTransport) && !errors.Is(err, ErrInvalidRequest)
+}
+
+// allowBreaker 在熔断打开时返回 *CircuitOpenError
+func (c *Client) allowBreaker(ctx context.Context, tags map[string]string) (uint64, error) {
+	if c.breaker == nil {
+		return 0, nil
+	}
+
+	generation, t, err := c.breaker.allow(time.Now())
+	c.breakerChanged(ctx, t)
+	if err != nil {
+		c.metrics.Counter(MetricBreakerRejected, 1, tags)
+	}
+
+	return generation, err
+}
+
+func (c *Client) recordBreaker(ctx context.Context, generation uint64, err error) {
+	if c.breaker == nil {
+		return
+	}
+	// 调用方取消或超时的请求不能说明服务的状态
+	if err != nil && ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		c.breaker.release(generation)
+		return
+	}
+
+	c.breakerChanged(ctx, c.breaker.record(generation, breakerFailure(err), time.Now()))
+}
+
+func (c *Client) breakerChanged(ctx context.Context, t *transition) {
+	if t == nil {
+		return
+	}
+
+	c.metrics.Counter(MetricBreakerState, 1, map[string]string{"from": t.from.String(), "to": t.to.String()})
+	if t.to == BreakerOpen {
+		logs.CtxWarnKvs(ctx, "msg", "circuit breaker opened", "from", t.from, "cool_down", c.breaker.policy.CoolDown)
+	} else {
+		logs.CtxInfoKvs(ctx, "msg", "circuit breaker state changed", "from", t.from, "to", t.to)
+	}
+}
+
+// BreakerState 返回熔断器当前的状态，未启用熔断时总是 BreakerClosed
+func (c *Client) BreakerState() BreakerState {
+	if c.breaker == nil {
+		return BreakerClosed
+	}
+	return c.breaker.current()
+}
@@ -0,0 +1,136 @@
+package deviceregister
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// breakerStep 是对熔断器的一次操作：at 时刻 allow 一次，allowed 时按 fail 记录结果
+type breakerStep struct {
+	at      time.Duration
+	fail    bool
+	allowed bool
+	state   BreakerState
+}
+
+func runBreaker(t *testing.T, p BreakerPolicy, steps []breakerStep) {
+	t.Helper()
+
+	b := newBreaker(p)
+	start := time.Date(2020, 12, 1, 8, 0, 0, 0, time.UTC)
+	for i, s := range steps {
+		now := start.Add(s.at)
+		generation, _, err := b.allow(now)
+		if allowed := err == nil; allowed != s.allowed {
+			t.Fatalf("step %d: allow err = %v, want allowed %v", i, err, s.allowed)
+		}
+		if err == nil {
+			b.record(generation, s.fail, now)
+		} else if !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("step %d: allow err = %v, want ErrCircuitOpen", i, err)
+		}
+		if got := b.current(); got != s.state {
+			t.Fatalf("step %d: state = %v, want %v", i, got, s.state)
+		}
+	}
+}
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	p := BreakerPolicy{ConsecutiveFailures: 2, CoolDown: 10 * time.Second, HalfOpenRequests: 1}
+	runBreaker(t, p, []breakerStep{
+		{at: 0, fail: true, allowed: true, state: BreakerClosed},
+		{at: 0, fail: false, allowed: true, state: BreakerClosed},
+		{at: 0, fail: true, allowed: true, state: BreakerClosed},
+		{at: 0, fail: true, allowed: true, state: BreakerOpen},
+		{at: 9 * time.Second, allowed: false, state: BreakerOpen},
+		// 冷却结束后放行一个探测，失败重新打开
+		{at: 10 * time.Second, fail: true, allowed: true, state: BreakerOpen},
+		{at: 15 * time.Second, allowed: false, state: BreakerOpen},
+		{at: 20 * time.Second, fail: false, allowed: true, state: BreakerClosed},
+		{at: 20 * time.Second, fail: true, allowed: true, state: BreakerClosed},
+	})
+}
+
+func TestBreakerFailureRatio(t *testing.T) {
+	p := BreakerPolicy{FailureRatio: 0.5, MinRequests: 4, Window: time.Minute, CoolDown: 10 * time.Second}
+	runBreaker(t, p, []breakerStep{
+		{at: 0, fail: true, allowed: true, state: BreakerClosed},
+		{at: 0, fail: false, allowed: true, state: BreakerClosed},
+		{at: 0, fail: true, allowed: true, state: BreakerClosed},
+		// 第 4 个请求达到 MinRequests，失败率 3/4
+		{at: 0, fail: true, allowed: true, state: BreakerOpen},
+	})
+	runBreaker(t, p, []breakerStep{
+		{at: 0, fail: true, allowed: true, state: BreakerClosed},
+		{at: 0, fail: true, allowed: true, state: BreakerClosed},
+		{at: 0, fail: true, allowed: true, state: BreakerClosed},
+		// 窗口滚动后重新计数
+		{at: time.Minute, fail: true, allowed: true, state: BreakerClosed},
+		{at: time.Minute, fail: false, allowed: true, state: BreakerClosed},
+	})
+}
+
+func TestBreakerHalfOpenProbes(t *testing.T) {
+	b := newBreaker(BreakerPolicy{ConsecutiveFailures: 1, CoolDown: time.Second, HalfOpenRequests: 2})
+	now := time.Date(2020, 12, 1, 8, 0, 0, 0, time.UTC)
+
+	g, _, _ := b.allow(now)
+	if tr := b.record(g, true, now); tr == nil || tr.from != BreakerClosed || tr.to != BreakerOpen {
+		t.Fatalf("transition = %+v, want closed to open", tr)
+	}
+	var coe *CircuitOpenError
+	if _, _, err := b.allow(now.Add(300 * time.Millisecond)); !errors.As(err, &coe) || coe.RetryAfter != 700*time.Millisecond {
+		t.Fatalf("allow during cool down = %v, want retry after 700ms", err)
+	}
+
+	now = now.Add(time.Second)
+	g1, tr, err := b.allow(now)
+	if err != nil || tr == nil || tr.to != BreakerHalfOpen {
+		t.Fatalf("first probe = %v, %+v, want half open", err, tr)
+	}
+	g2, _, err := b.allow(now)
+	if err != nil {
+		t.Fatalf("second probe: %v", err)
+	}
+	if _, _, err := b.allow(now); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("third probe err = %v, want ErrCircuitOpen", err)
+	}
+
+	// 取消的探测归还名额
+	b.release(g2)
+	g3, _, err := b.allow(now)
+	if err != nil {
+		t.Fatalf("probe after release: %v", err)
+	}
+
+	b.record(g1, false, now)
+	if tr := b.record(g3, false, now); tr == nil || tr.to != BreakerClosed {
+		t.Fatalf("transition = %+v, want half open to closed", tr)
+	}
+	// 状态变化之前发出的请求结果被忽略
+	if tr := b.record(g2, true, now); tr != nil || b.current() != BreakerClosed {
+		t.Errorf("stale record changed state to %v", b.current())
+	}
+}
+
+func TestBreakerFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&TransportError{Err: errors.New("reset")}, true},
+		{&StatusError{StatusCode: 500}, true},
+		{&StatusError{StatusCode: 503}, true},
+		{&StatusError{StatusCode: 429}, false},
+		{&StatusError{StatusCode: 400}, false},
+		{&DecodeError{Err: errors.New("eof")}, false},
+		{&ValidationError{Field: "aid", Reason: "must not be zero"}, false},
+	}
+	for _, tt := range tests {
+		if got := breakerFailure(tt.err); got != tt.want {
+			t.Errorf("breakerFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
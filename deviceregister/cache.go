@@ -0,0 +1,300 @@
+package deviceregister
+
+import (
+	"bufio"
+	"code.byted.org/gopkg/logs"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// CacheKey 唯一确定一次注册
+type CacheKey struct {
+	AppId        uint32 `json:"app_id"`
+	UserUniqueId string `json:"user_unique_id"`
+	Os           string `json:"os"`
+}
+
+// cacheKey 使用平台的规范名，ios 和 iOS 命中同一条缓存
+func (dr DeviceRegister) cacheKey(p Platform) CacheKey {
+	return CacheKey{AppId: dr.AppId, UserUniqueId: dr.UserUniqueId, Os: p.Name}
+}
+
+// Cache 缓存注册结果，命中时 Client 不再发起请求。实现必须可以并发使用
+type Cache interface {
+	Get(key CacheKey) (*Response, bool)
+	Set(key CacheKey, res *Response) error
+	Invalidate(key CacheKey) error
+}
+
+// WithCache 设置注册结果缓存
+func WithCache(cache Cache) Option {
+	return func(c *Client) {
+		c.cache = cache
+	}
+}
+
+// CacheStats 是 FileCache 的统计
+type CacheStats struct {
+	Entries int
+	Hits    int64
+	Misses  int64
+	// Expired 是因过期而未命中的次数
+	Expired int64
+	// LogRecords 是文件中的记录数，远大于 Entries 时应该 Compact
+	LogRecords int
+}
+
+// FileCache 是 Cache 的默认实现：内存中保存全部条目，
+// 每次 Set/Invalidate 追加一条记录到文件，打开时重放文件恢复，从第一条损坏的记录开始截断。
+// 文件只增不减，用 Compact 重写为当前的有效条目。
+type FileCache struct {
+	mu      sync.Mutex
+	path    string
+	ttl     time.Duration
+	f       *os.File
+	entries map[CacheKey]cacheEntry
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	Response  *Response
+	ExpiresAt time.Time
+}
+
+type cacheRecord struct {
+	Op        string    `json:"op"`
+	Key       CacheKey  `json:"key"`
+	Response  *Response `json:"response,omitempty"`
+	ExpiresAt int64     `json:"expires_at,omitempty"`
+}
+
+const (
+	cacheOpSet = "set"
+	cacheOpDel = "del"
+)
+
+// OpenFileCache 打开 path 处的缓存文件，不存在则创建。ttl 为 0 表示永不过期
+func OpenFileCache(path string, ttl time.Duration) (*FileCache, error) {
+	if ttl < 0 {
+		return nil, fmt.Errorf("deviceregister: cache ttl must not be negative, got %v", ttl)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("deviceregister: open cache: %v", err)
+	}
+
+	c := &FileCache{path: path, ttl: ttl, f: f, entries: make(map[CacheKey]cacheEntry)}
+	if err := c.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("deviceregister: load cache %s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+func (c *FileCache) load() error {
+	now := time.Now()
+	r := bufio.NewReader(c.f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// 没有换行结尾的最后一行是写到一半的记录，丢弃
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec cacheRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			logs.Warn("deviceregister: cache %s is corrupt at offset %d, dropping the rest of it: %v", c.path, offset, err)
+			break
+		}
+		offset += int64(len(line))
+		c.stats.LogRecords++
+
+		switch rec.Op {
+		case cacheOpSet:
+			e := cacheEntry{Response: rec.Response}
+			if rec.ExpiresAt != 0 {
+				e.ExpiresAt = time.Unix(0, rec.ExpiresAt)
+			}
+			if e.expired(now) {
+				delete(c.entries, rec.Key)
+			} else {
+				c.entries[rec.Key] = e
+			}
+		case cacheOpDel:
+			delete(c.entries, rec.Key)
+		}
+	}
+
+	if err := c.f.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := c.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (e cacheEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+func (c *FileCache) Get(key CacheKey) (*Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	if e.expired(time.Now()) {
+		// 过期的条目在下一次 Compact 时从文件中移除
+		delete(c.entries, key)
+		c.stats.Misses++
+		c.stats.Expired++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	res := *e.Response
+	return &res, true
+}
+
+func (c *FileCache) Set(key CacheKey, res *Response) error {
+	if res == nil {
+		return c.Invalidate(key)
+	}
+
+	cp := *res
+	e := cacheEntry{Response: &cp}
+	rec := cacheRecord{Op: cacheOpSet, Key: key, Response: &cp}
+	if c.ttl > 0 {
+		e.ExpiresAt = time.Now().Add(c.ttl)
+		rec.ExpiresAt = e.ExpiresAt.UnixNano()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.append(rec); err != nil {
+		return err
+	}
+	c.entries[key] = e
+
+	return nil
+}
+
+func (c *FileCache) Invalidate(key CacheKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		return nil
+	}
+	if err := c.append(cacheRecord{Op: cacheOpDel, Key: key}); err != nil {
+		return err
+	}
+	delete(c.entries, key)
+
+	return nil
+}
+
+// append 追加一条记录，写入失败时截断到写入前的位置，不在文件中留下半条记录
+func (c *FileCache) append(rec cacheRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	offset, err := c.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("deviceregister: write cache: %v", err)
+	}
+	if _, err := c.f.Write(append(b, '\n')); err != nil {
+		if terr := c.f.Truncate(offset); terr == nil {
+			c.f.Seek(offset, io.SeekStart)
+		}
+		return fmt.Errorf("deviceregister: write cache: %v", err)
+	}
+	c.stats.LogRecords++
+
+	return nil
+}
+
+func (c *FileCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Entries = len(c.entries)
+	return s
+}
+
+// Compact 把未过期的条目写入临时文件后替换原文件
+func (c *FileCache) Compact() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmpPath := c.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("deviceregister: compact cache: %v", err)
+	}
+
+	now := time.Now()
+	w := bufio.NewWriter(tmp)
+	records := 0
+	for key, e := range c.entries {
+		if e.expired(now) {
+			delete(c.entries, key)
+			continue
+		}
+
+		rec := cacheRecord{Op: cacheOpSet, Key: key, Response: e.Response}
+		if !e.ExpiresAt.IsZero() {
+			rec.ExpiresAt = e.ExpiresAt.UnixNano()
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+		records++
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("deviceregister: compact cache: %v", err)
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("deviceregister: compact cache: %v", err)
+	}
+
+	c.f.Close()
+	c.f = tmp
+	c.stats.LogRecords = records
+
+	return nil
+}
+
+func (c *FileCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.f.Close()
+}
@@ -0,0 +1,208 @@
+package deviceregister_test
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func cachePath(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "register.cache")
+}
+
+func openCache(t *testing.T, path string, ttl time.Duration) *deviceregister.FileCache {
+	t.Helper()
+
+	c, err := deviceregister.OpenFileCache(path, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func cacheKey(user string) deviceregister.CacheKey {
+	return deviceregister.CacheKey{AppId: 10000012, UserUniqueId: user, Os: "ios"}
+}
+
+func TestFileCacheCompact(t *testing.T) {
+	path := cachePath(t)
+	c := openCache(t, path, 0)
+
+	steps := []struct {
+		user     string
+		deviceId uint64
+	}{
+		{"u1", 1},
+		{"u1", 2},
+		{"u2", 3},
+		{"u3", 4},
+	}
+	for _, s := range steps {
+		if err := c.Set(cacheKey(s.user), &deviceregister.Response{DeviceId: s.deviceId}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Invalidate(cacheKey("u3")); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Entries != 2 || s.LogRecords != 5 {
+		t.Fatalf("before compact Stats = %+v, want 2 entries in 5 records", s)
+	}
+
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Entries != 2 || s.LogRecords != 2 {
+		t.Fatalf("after compact Stats = %+v, want 2 entries in 2 records", s)
+	}
+	// 压缩后继续追加到新文件
+	if err := c.Set(cacheKey("u4"), &deviceregister.Response{DeviceId: 5}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c = openCache(t, path, 0)
+	defer c.Close()
+	if s := c.Stats(); s.Entries != 3 || s.LogRecords != 3 {
+		t.Errorf("reopened Stats = %+v, want 3 entries in 3 records", s)
+	}
+	tests := []struct {
+		user     string
+		deviceId uint64
+		ok       bool
+	}{
+		{"u1", 2, true},
+		{"u2", 3, true},
+		{"u3", 0, false},
+		{"u4", 5, true},
+	}
+	for _, tt := range tests {
+		res, ok := c.Get(cacheKey(tt.user))
+		if ok != tt.ok || ok && res.DeviceId != tt.deviceId {
+			t.Errorf("Get(%s) = %+v, %v, want device_id %d, %v", tt.user, res, ok, tt.deviceId, tt.ok)
+		}
+	}
+}
+
+func TestFileCacheCompactDropsExpired(t *testing.T) {
+	path := cachePath(t)
+	c := openCache(t, path, 50*time.Millisecond)
+	defer c.Close()
+
+	if err := c.Set(cacheKey("u1"), &deviceregister.Response{DeviceId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	if _, ok := c.Get(cacheKey("u1")); ok {
+		t.Error("Get returned an expired entry")
+	}
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Entries != 0 || s.LogRecords != 0 || s.Expired != 1 {
+		t.Errorf("Stats = %+v, want no entries and 1 expired", s)
+	}
+}
+
+func TestFileCacheTruncatedTail(t *testing.T) {
+	path := cachePath(t)
+	c := openCache(t, path, 0)
+	if err := c.Set(cacheKey("u1"), &deviceregister.Response{DeviceId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// 模拟写到一半时进程退出
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"set","key":{"app_id":10000012`)
+	f.Close()
+
+	c = openCache(t, path, 0)
+	defer c.Close()
+	if res, ok := c.Get(cacheKey("u1")); !ok || res.DeviceId != 1 {
+		t.Errorf("Get(u1) = %+v, %v, want device_id 1", res, ok)
+	}
+	if s := c.Stats(); s.LogRecords != 1 {
+		t.Errorf("Stats = %+v, want the partial record dropped", s)
+	}
+}
+
+func TestFileCacheCorruptRecord(t *testing.T) {
+	path := cachePath(t)
+	c := openCache(t, path, 0)
+	if err := c.Set(cacheKey("u1"), &deviceregister.Response{DeviceId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// 写失败留下的半条记录后面又追加了完整的记录
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"set","key":{"app_id":1` + "\n")
+	f.WriteString(`{"op":"set","key":{"app_id":10000012,"user_unique_id":"u2","os":"ios"},"response":{"device_id":2}}` + "\n")
+	f.Close()
+
+	c = openCache(t, path, 0)
+	if res, ok := c.Get(cacheKey("u1")); !ok || res.DeviceId != 1 {
+		t.Errorf("Get(u1) = %+v, %v, want device_id 1", res, ok)
+	}
+	if _, ok := c.Get(cacheKey("u2")); ok {
+		t.Error("Get(u2) hit a record after the corrupt one")
+	}
+	if err := c.Set(cacheKey("u3"), &deviceregister.Response{DeviceId: 3}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c = openCache(t, path, 0)
+	defer c.Close()
+	if s := c.Stats(); s.Entries != 2 || s.LogRecords != 2 {
+		t.Errorf("reopened Stats = %+v, want u1 and u3 in 2 records", s)
+	}
+}
+
+func TestRegisterUsesCache(t *testing.T) {
+	s, ts := mockserver.Start()
+	defer ts.Close()
+
+	cache := openCache(t, cachePath(t), time.Hour)
+	defer cache.Close()
+	c := testClient(t, ts.URL, deviceregister.WithCache(cache))
+
+	dr := testDevice()
+	first, err := c.Register(context.Background(), dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 平台名大小写不同也命中同一条缓存
+	dr.Os = "iOS"
+	second, err := c.Register(context.Background(), dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.Requests(); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+	if second.DeviceId != first.DeviceId {
+		t.Errorf("cached device_id = %d, want %d", second.DeviceId, first.DeviceId)
+	}
+}
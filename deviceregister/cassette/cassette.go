@@ -0,0 +1,472 @@
+// Package cassette 录制和回放 device_register 的 HTTP 交互，
+// 录制一次真实的请求和响应，之后的测试不需要任何服务端：
+//
+//	rec, err := cassette.New("testdata/register.json", cassette.ModeReplay)
+//	client, err := deviceregister.NewClient(deviceregister.WithHTTPClient(&http.Client{Transport: rec}))
+//
+// 回放时按 method、path 和归一化后的请求体匹配，没有匹配的录制时返回 ErrNoRecording。
+// gzip 压缩的请求体按 Content-Encoding 解压后保存和匹配，与是否开启 WithGzip 无关。
+package cassette
+
+import (
+	"bytes"
+	"code.byted.org/gopkg/logs"
+	"compress/gzip"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/signing"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Redacted 替换被脱敏的请求头和请求体字段
+const Redacted = "[REDACTED]"
+
+// ErrNoRecording 表示回放时没有找到匹配的录制
+var ErrNoRecording = errors.New("cassette: no recorded interaction matches the request")
+
+type Mode int
+
+const (
+	// ModeReplay 只从文件回放，不发出真实请求
+	ModeReplay Mode = iota
+	// ModeRecord 发出真实请求，并把交互追加到文件
+	ModeRecord
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeReplay:
+		return "replay"
+	case ModeRecord:
+		return "record"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(s) {
+	case "replay":
+		return ModeReplay, nil
+	case "record":
+		return ModeRecord, nil
+	default:
+		return 0, fmt.Errorf("cassette: unknown mode %q, expect record or replay", s)
+	}
+}
+
+// Cassette 是录制文件的内容
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body"`
+}
+
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       Body        `json:"body"`
+}
+
+// Body 是 UTF-8 文本时原样保存，方便阅读和修改，否则保存为 base64
+type Body []byte
+
+func (b Body) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString(b)})
+}
+
+func (b *Body) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = Body(s)
+		return nil
+	}
+
+	var enc struct {
+		Base64 string `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return fmt.Errorf("cassette: body must be a string or {\"base64\": ...}: %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(enc.Base64)
+	if err != nil {
+		return fmt.Errorf("cassette: invalid base64 body: %v", err)
+	}
+	*b = raw
+	return nil
+}
+
+// Recorder 是录制或回放的 http.RoundTripper，可以被多个 goroutine 共用
+type Recorder struct {
+	path string
+	mode Mode
+	// transport 是录制时实际发请求的 RoundTripper
+	transport http.RoundTripper
+	// redactHeaders 是需要脱敏的请求头和响应头，已经规范化
+	redactHeaders map[string]bool
+	// redactFields 是请求体中需要脱敏的 JSON 字段，形如 header.vendor_id
+	redactFields [][]string
+
+	mu       sync.Mutex
+	cassette Cassette
+	// replayed 是每个录制已经回放的次数，用于同一个请求多次录制时按顺序回放
+	replayed []int
+}
+
+type Option func(r *Recorder)
+
+// WithTransport 设置录制时使用的 RoundTripper，默认 http.DefaultTransport
+func WithTransport(rt http.RoundTripper) Option {
+	return func(r *Recorder) {
+		r.transport = rt
+	}
+}
+
+// WithRedactHeaders 追加需要脱敏的请求头和响应头
+func WithRedactHeaders(names ...string) Option {
+	return func(r *Recorder) {
+		for _, name := range names {
+			r.redactHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+}
+
+// WithRedactFields 追加请求体中需要脱敏的 JSON 字段，用 . 分隔层级。
+// 脱敏的字段在匹配时也会被忽略，所以随机生成的值（如设备标识）需要放在这里。
+func WithRedactFields(fields ...string) Option {
+	return func(r *Recorder) {
+		for _, f := range fields {
+			r.redactFields = append(r.redactFields, strings.Split(f, "."))
+		}
+	}
+}
+
+// DefaultRedactHeaders 是默认脱敏的请求头
+func DefaultRedactHeaders() []string {
+	return []string{"Authorization", "Cookie", "Set-Cookie", signing.HeaderSignature}
+}
+
+// DefaultRedactFields 是默认脱敏的请求体字段：所有已注册平台的设备标识字段，
+// 没有开启 WithDeterministicUDID 时它们每次都是随机的
+func DefaultRedactFields() []string {
+	seen := make(map[string]bool)
+	var fields []string
+	for _, name := range deviceregister.Platforms() {
+		p, err := deviceregister.LookupPlatform(name)
+		if err != nil || seen[p.IdentifierField] {
+			continue
+		}
+		seen[p.IdentifierField] = true
+		fields = append(fields, "header."+p.IdentifierField)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+// New 打开 path 对应的录制文件。回放时文件必须存在；录制时文件不存在会新建，存在则追加。
+// 默认脱敏 DefaultRedactHeaders 和 DefaultRedactFields。
+func New(path string, mode Mode, opts ...Option) (*Recorder, error) {
+	r := &Recorder{
+		path:          path,
+		mode:          mode,
+		transport:     http.DefaultTransport,
+		redactHeaders: make(map[string]bool),
+	}
+	if mode != ModeReplay && mode != ModeRecord {
+		return nil, fmt.Errorf("cassette: unknown mode %v", mode)
+	}
+	WithRedactHeaders(DefaultRedactHeaders()...)(r)
+	WithRedactFields(DefaultRedactFields()...)(r)
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err) && mode == ModeRecord:
+	case err != nil:
+		return nil, fmt.Errorf("cassette: read %s: %v", path, err)
+	default:
+		if err := json.Unmarshal(data, &r.cassette); err != nil {
+			return nil, fmt.Errorf("cassette: parse %s: %v", path, err)
+		}
+	}
+	r.replayed = make([]int, len(r.cassette.Interactions))
+
+	return r, nil
+}
+
+// Interactions 返回当前所有的录制
+func (r *Recorder) Interactions() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Interaction(nil), r.cassette.Interactions...)
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.mode == ModeReplay {
+		return r.replay(req, body)
+	}
+	return r.record(req, body)
+}
+
+// decodeBody 按 Content-Encoding 解压请求体，解压失败时原样返回
+func decodeBody(req *http.Request, body []byte) []byte {
+	if !strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+		return body
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body
+	}
+	defer zr.Close()
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return body
+	}
+	return plain
+}
+
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	key := r.normalize(decodeBody(req, body))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// 同一个请求录制了多次时按顺序回放，用完后重复最后一次
+	found, last := -1, -1
+	for i, it := range r.cassette.Interactions {
+		if !r.matches(it.Request, req, key) {
+			continue
+		}
+		last = i
+		if r.replayed[i] == 0 {
+			found = i
+			break
+		}
+	}
+	if found < 0 {
+		found = last
+	}
+	if found < 0 {
+		err := &NoRecordingError{Method: req.Method, Path: req.URL.Path, Body: key, Cassette: r.path}
+		logs.Error("%v", err)
+		return nil, err
+	}
+	r.replayed[found]++
+
+	return r.cassette.Interactions[found].Response.httpResponse(req), nil
+}
+
+func (r *Recorder) matches(rec Request, req *http.Request, key string) bool {
+	if !strings.EqualFold(rec.Method, req.Method) {
+		return false
+	}
+	if urlPath(rec.URL) != req.URL.Path {
+		return false
+	}
+	return r.normalize(rec.Body) == key
+}
+
+func (r *Recorder) record(req *http.Request, body []byte) (*http.Response, error) {
+	// RoundTripper 不能修改 req，请求体已经读完，换一个副本发出
+	out := req.Clone(req.Context())
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp, err := r.transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	u := *req.URL
+	u.User = nil
+	it := Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    u.String(),
+			Header: r.redactHeader(req.Header),
+			Body:   r.redactBody(decodeBody(req, body)),
+		},
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Header:     r.redactHeader(resp.Header),
+			Body:       respBody,
+		},
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cassette.Interactions = append(r.cassette.Interactions, it)
+	r.replayed = append(r.replayed, 0)
+	if err := r.save(); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// save 先写临时文件再改名，调用方持有 mu
+func (r *Recorder) save() error {
+	data, err := json.MarshalIndent(r.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("cassette: save %s: %v", r.path, err)
+	}
+	if err := os.Rename(tmpPath, r.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cassette: save %s: %v", r.path, err)
+	}
+
+	return nil
+}
+
+func (r *Recorder) redactHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		if r.redactHeaders[http.CanonicalHeaderKey(k)] {
+			out[k] = []string{Redacted}
+			continue
+		}
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// redactBody 只处理 JSON 对象，其他内容原样返回
+func (r *Recorder) redactBody(body []byte) []byte {
+	var v map[string]interface{}
+	if len(r.redactFields) == 0 || json.Unmarshal(body, &v) != nil {
+		return body
+	}
+
+	for _, field := range r.redactFields {
+		redactField(v, field)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// normalize 返回用于匹配的请求体：JSON 脱敏后按 key 排序重新编码，其他内容去掉首尾空白
+func (r *Recorder) normalize(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return string(bytes.TrimSpace(body))
+	}
+
+	if m, ok := v.(map[string]interface{}); ok {
+		for _, field := range r.redactFields {
+			redactField(m, field)
+		}
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+func redactField(m map[string]interface{}, field []string) {
+	for i, key := range field {
+		v, ok := m[key]
+		if !ok {
+			return
+		}
+		if i == len(field)-1 {
+			m[key] = Redacted
+			return
+		}
+		if m, ok = v.(map[string]interface{}); !ok {
+			return
+		}
+	}
+}
+
+func (res Response) httpResponse(req *http.Request) *http.Response {
+	header := res.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode)),
+		StatusCode:    res.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(res.Body)),
+		ContentLength: int64(len(res.Body)),
+		Request:       req,
+	}
+}
+
+func urlPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// NoRecordingError 是 ErrNoRecording 的详细信息，Body 是归一化后的请求体。
+// 它同时满足 errors.Is(err, deviceregister.ErrInvalidRequest)，Client 不会重试，也不会写入离线队列。
+type NoRecordingError struct {
+	Method   string
+	Path     string
+	Body     string
+	Cassette string
+}
+
+func (e *NoRecordingError) Error() string {
+	return fmt.Sprintf("%v: %s %s in %s, body %s", ErrNoRecording, e.Method, e.Path, e.Cassette, e.Body)
+}
+
+func (e *NoRecordingError) Is(target error) bool {
+	return target == ErrNoRecording || target == deviceregister.ErrInvalidRequest
+}
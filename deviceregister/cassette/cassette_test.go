@@ -0,0 +1,86 @@
+package cassette_test
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/cassette"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testdata/register.json 是用 practise/test_http -mock -cassette-mode record 录制的
+const registerCassette = "testdata/register.json"
+
+func device(userUniqueId string) deviceregister.DeviceRegister {
+	return deviceregister.DeviceRegister{
+		UserUniqueId: userUniqueId,
+		AppId:        10000012,
+		Os:           "ios",
+		Profile: &deviceregister.Profile{
+			DeviceModel: "iPhone12,1",
+			OsVersion:   "14.2",
+			AppVersion:  "1.0.0",
+			Language:    "zh",
+			Region:      "CN",
+		},
+	}
+}
+
+func replayClient(t *testing.T, opts ...deviceregister.Option) *deviceregister.Client {
+	t.Helper()
+
+	rec, err := cassette.New(registerCassette, cassette.ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]deviceregister.Option{deviceregister.WithHTTPClient(&http.Client{Transport: rec})}, opts...)
+	c, err := deviceregister.NewClient(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		gzip bool
+	}{
+		{"plain", false},
+		{"gzip", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := replayClient(t, deviceregister.WithGzip(tt.gzip))
+			res, err := c.Register(context.Background(), device("276095447832965"))
+			if err != nil {
+				t.Fatalf("Register: %v", err)
+			}
+			if res.DeviceId == 0 || res.BdDid == "" || res.NewUser != 1 {
+				t.Errorf("Register = %+v, want the recorded response", res)
+			}
+		})
+	}
+}
+
+func TestReplayNoRecording(t *testing.T) {
+	c := replayClient(t, deviceregister.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second}))
+
+	start := time.Now()
+	_, err := c.Register(context.Background(), device("not-recorded"))
+	if !errors.Is(err, cassette.ErrNoRecording) {
+		t.Fatalf("Register error = %v, want ErrNoRecording", err)
+	}
+	if k := deviceregister.KindOf(err); k != deviceregister.KindInvalidRequest {
+		t.Errorf("KindOf = %v, want %v", k, deviceregister.KindInvalidRequest)
+	}
+	if deviceregister.IsRetryable(err) {
+		t.Error("IsRetryable = true, want false")
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("Register took %v, want no retry", d)
+	}
+}
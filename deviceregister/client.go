@@ -0,0 +1,367 @@
+package deviceregister
+
+import (
+	"bytes"
+	"code.byted.org/gopkg/logs"
+	"context"
+	"do_some_fxxking_test/deviceregister/signing"
+	"do_some_fxxking_test/deviceregister/spool"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultEndpoint = "http://10.225.130.116/service/2/device_register/"
+	DefaultHost     = "snssdk.vpc.com"
+	DefaultTimeout  = time.Second * 30
+)
+
+// Client 负责向 device_register 发起注册请求，可以被多个 goroutine 共用
+type Client struct {
+	endpoint   string
+	endpoints  []string
+	host       string
+	timeout    time.Duration
+	httpClient *http.Client
+	retry      RetryPolicy
+	tls        *TLSConfig
+	proxy      *ProxyConfig
+
+	pool            *endpointPool
+	balancer        Balancer
+	outlier         OutlierPolicy
+	healthCheck     *HealthCheck
+	stopHealthCheck func()
+
+	deterministicUDID bool
+	udidNamespace     string
+
+	cache       Cache
+	metrics     MetricsSink
+	breaker     *breaker
+	credentials *signing.Credentials
+
+	offline *spool.Queue
+
+	gzip             bool
+	maxResponseBytes int64
+
+	redaction     Redaction
+	redactionSalt string
+	debugPayloads bool
+}
+
+type Option func(c *Client)
+
+// WithEndpoint 设置 device_register 的完整地址，覆盖 WithEndpoints
+func WithEndpoint(endpoint string) Option {
+	return func(c *Client) {
+		c.endpoint = endpoint
+		c.endpoints = nil
+	}
+}
+
+// WithHost 设置请求的 Host 头，为空时使用 endpoint 中的 host
+func WithHost(host string) Option {
+	return func(c *Client) {
+		c.host = host
+	}
+}
+
+// WithTimeout 设置单次请求的超时时间
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithHTTPClient 使用调用方提供的 http.Client，此时 WithTimeout 不生效，也不能使用 WithTLS 和 WithProxy
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+func NewClient(opts ...Option) (*Client, error) {
+	c := &Client{
+		endpoint: DefaultEndpoint,
+		host:     DefaultHost,
+		timeout:  DefaultTimeout,
+		retry:    DefaultRetryPolicy(),
+		outlier:  DefaultOutlierPolicy(),
+		metrics:  nopSink{},
+
+		maxResponseBytes: DefaultMaxResponseBytes,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if len(c.endpoints) == 0 {
+		c.endpoints = []string{c.endpoint}
+	}
+	cfg := Config{Endpoints: c.endpoints, Host: c.host, Timeout: Duration(c.timeout)}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := c.retry.Validate(); err != nil {
+		return nil, err
+	}
+	if c.balancer < RoundRobin || c.balancer > LeastInFlight {
+		return nil, fmt.Errorf("deviceregister: unknown balancer %v", c.balancer)
+	}
+	if err := c.outlier.validate(); err != nil {
+		return nil, err
+	}
+	if c.healthCheck != nil {
+		if err := c.healthCheck.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if c.breaker != nil {
+		if err := c.breaker.policy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if c.maxResponseBytes <= 0 {
+		return nil, fmt.Errorf("deviceregister: max response bytes must be positive, got %d", c.maxResponseBytes)
+	}
+	if c.credentials != nil {
+		if err := c.credentials.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if c.redaction < RedactHash || c.redaction > RedactNone {
+		return nil, fmt.Errorf("deviceregister: unknown redaction %v", c.redaction)
+	}
+	if c.deterministicUDID && c.udidNamespace == "" {
+		return nil, errors.New("deviceregister: udid namespace must not be empty")
+	}
+	if c.httpClient != nil && (c.tls != nil || c.proxy != nil) {
+		return nil, errors.New("deviceregister: WithTLS and WithProxy cannot be used with WithHTTPClient, configure its transport instead")
+	}
+	if c.httpClient == nil {
+		tr, err := c.newTransport()
+		if err != nil {
+			return nil, err
+		}
+		c.httpClient = &http.Client{Timeout: c.timeout, Transport: tr}
+	}
+	if c.metrics == nil {
+		c.metrics = nopSink{}
+	}
+
+	c.pool = newEndpointPool(c.endpoints, c.balancer, c.outlier)
+	if c.healthCheck != nil {
+		c.startHealthCheck()
+	}
+
+	return c, nil
+}
+
+// Register 根据 user_unique_id 和 app_id 注册 device_id，返回完整的注册结果
+// 仅适用于私有化
+// 配置了 WithOfflineQueue 时，网络不可用导致的失败会把请求写入队列并返回 QueuedError。
+func (c *Client) Register(ctx context.Context, dr DeviceRegister) (*Response, error) {
+	return c.registerDevice(ctx, dr, nil, true)
+}
+
+// registerDevice 是 Register 的实现。body 不为 nil 时原样发送，不重新生成 udid；
+// queue 为 false 时失败不写入离线队列，这两个参数用于重放队列中的请求。
+func (c *Client) registerDevice(ctx context.Context, dr DeviceRegister, body []byte, queue bool) (*Response, error) {
+	ctx = ensureTraceID(ctx)
+	ctx = logs.CtxAddKVs(ctx, "trace_id", TraceID(ctx), "app_id", dr.AppId, "os", dr.Os,
+		"user_unique_id", c.redact(dr.UserUniqueId))
+
+	p, err := dr.platform()
+	tags := metricTags(dr, p)
+	if err != nil {
+		c.metrics.Counter(MetricFailure, 1, withTag(tags, "kind", KindOf(err).String()))
+		logs.CtxErrorKvs(ctx, "msg", "invalid register request", "err", err)
+		return nil, err
+	}
+
+	if c.cache != nil {
+		if res, ok := c.cache.Get(dr.cacheKey(p)); ok {
+			c.metrics.Counter(MetricCacheHit, 1, tags)
+			logs.CtxInfoKvs(ctx, "msg", "register cache hit", "bd_did", c.redact(res.BdDid))
+			return res, nil
+		}
+	}
+
+	start := time.Now()
+	res, body, err := c.register(ctx, dr, p, tags, body)
+	latency := time.Since(start)
+	c.metrics.Timer(MetricLatency, latency, tags)
+	if err != nil {
+		c.metrics.Counter(MetricFailure, 1, withTag(tags, "kind", KindOf(err).String()))
+		logs.CtxErrorKvs(ctx, "msg", "register failed", "kind", KindOf(err), "latency", latency,
+			"err", c.logError(ctx, err))
+		if queue {
+			return nil, c.enqueue(ctx, dr, body, tags, err)
+		}
+		return nil, err
+	}
+	c.metrics.Counter(MetricSuccess, 1, tags)
+	logs.CtxInfoKvs(ctx, "msg", "register succeeded", "latency", latency, "new_user", res.NewUser,
+		"device_id", c.redact(strconv.FormatUint(res.DeviceId, 10)), "bd_did", c.redact(res.BdDid))
+
+	if c.cache != nil {
+		if err := c.cache.Set(dr.cacheKey(p), res); err != nil {
+			logs.CtxWarnKvs(ctx, "msg", "set register cache failed", "err", err)
+		}
+	}
+
+	return res, nil
+}
+
+// register 发送注册请求并按 RetryPolicy 重试，返回实际发送的未压缩请求体。
+// bodyJson 为 nil 时生成新的 udid 和请求体，否则原样发送 bodyJson。
+func (c *Client) register(ctx context.Context, dr DeviceRegister, p Platform, tags map[string]string, bodyJson []byte) (*Response, []byte, error) {
+	var udid string
+	if bodyJson == nil {
+		var err error
+		if udid, err = c.udid(dr); err != nil {
+			return nil, nil, err
+		}
+		if bodyJson, err = json.Marshal(dr.generateBody(p, udid)); err != nil {
+			return nil, nil, err
+		}
+	}
+	// debug 是显式开启的，用 Info 级别保证能输出
+	if c.debug(ctx) {
+		logs.CtxInfoKvs(ctx, "msg", "register request", "host", c.host, "body", string(bodyJson))
+	} else if udid != "" {
+		logs.CtxDebugKvs(ctx, "msg", "register request", p.IdentifierField, c.redact(udid))
+	}
+	payload := bodyJson
+	if c.gzip {
+		var err error
+		if payload, err = gzipBody(bodyJson); err != nil {
+			return nil, bodyJson, err
+		}
+	}
+
+	var (
+		e     *endpoint
+		tried = make(map[*endpoint]bool)
+	)
+	for attempt := 1; ; attempt++ {
+		generation, err := c.allowBreaker(ctx, tags)
+		if err != nil {
+			return nil, bodyJson, err
+		}
+
+		if e == nil {
+			e = c.pool.pick(tried, time.Now())
+			tried[e] = true
+		} else {
+			c.pool.retain(e)
+		}
+
+		c.metrics.Counter(MetricAttempt, 1, tags)
+		start := time.Now()
+		res, sent, err := c.do(ctx, e.url, dr.AppId, payload)
+		c.recordBreaker(ctx, generation, err)
+		c.recordEndpoint(ctx, e, err)
+		c.metrics.Timer(MetricAttemptLatency, time.Since(start), tags)
+		if err == nil {
+			return res, bodyJson, nil
+		}
+		// 调用方的 ctx 已经结束时不再重试，单次请求超时仍然重试
+		if attempt >= c.retry.Attempts() || ctx.Err() != nil || !retryable(err) {
+			return nil, bodyJson, err
+		}
+
+		delay, ok := c.retry.RetryDelay(attempt, err)
+		if !ok {
+			logs.CtxWarnKvs(ctx, "msg", "register Retry-After exceeds the max delay, give up", "attempt", attempt,
+				"endpoint", e.url, "err", c.logError(ctx, err))
+			return nil, bodyJson, err
+		}
+		// 只有确定没有注册过时才换 endpoint，否则在同一个 endpoint 上重试
+		failover := len(c.pool.endpoints) > 1 && failoverSafe(err, sent)
+		logs.CtxWarnKvs(ctx, "msg", "register attempt failed, will retry", "attempt", attempt, "delay", delay,
+			"endpoint", e.url, "failover", failover, "kind", KindOf(err), "err", c.logError(ctx, err))
+		c.metrics.Counter(MetricRetry, 1, withTag(tags, "kind", KindOf(err).String()))
+		if failover {
+			c.metrics.Counter(MetricFailover, 1, tags)
+			e = nil
+		}
+
+		if err := sleepCtx(ctx, delay); err != nil {
+			return nil, bodyJson, err
+		}
+	}
+}
+
+// do 向 endpoint 发起一次请求，每次都用 body 重新构造请求体，开启 WithGzip 时 body 已经压缩。
+// sent 表示请求体是否已经完整发出，没有发出时服务端一定没有处理这次请求。
+func (c *Client) do(ctx context.Context, endpoint string, appId uint32, body []byte) (res *Response, sent bool, err error) {
+	var wrote int32
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				atomic.StoreInt32(&wrote, 1)
+			}
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	c.setHeaders(req, appId, body)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, atomic.LoadInt32(&wrote) == 1, &TransportError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	res, err = c.decode(ctx, resp)
+	return res, true, err
+}
+
+func (c *Client) decode(ctx context.Context, resp *http.Response) (*Response, error) {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := readBody(resp, bodyExcerptLimit)
+		return nil, &StatusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			Body:       respBody,
+		}
+	}
+
+	respBody, err := readBody(resp, c.maxResponseBytes)
+	if err == ErrResponseTooLarge {
+		return nil, &DecodeError{Err: err, Body: excerpt(respBody)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.debug(ctx) {
+		logs.CtxInfoKvs(ctx, "msg", "register response", "status", resp.StatusCode, "body", string(respBody))
+	}
+
+	res, warnings, err := decodeResponse(respBody)
+	if err != nil {
+		return nil, &DecodeError{Err: err, Body: excerpt(respBody)}
+	}
+	if len(warnings) > 0 {
+		logs.CtxWarnKvs(ctx, "msg", "register response decoded with warnings", "warnings", strings.Join(warnings, "; "))
+	}
+
+	if res.DeviceId == 0 && res.BdDid == "" && res.Cd == "" {
+		return nil, ErrEmptyIdentity
+	}
+
+	return res, nil
+}
@@ -0,0 +1,80 @@
+package deviceregister
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxResponseBytes 是解压后响应体的默认上限
+const DefaultMaxResponseBytes = 1 << 20
+
+// ErrResponseTooLarge 表示解压后的响应体超过上限，会被归类为 KindMalformedResponse
+var ErrResponseTooLarge = errors.New("deviceregister: response body too large")
+
+// WithGzip 开启后请求体使用 gzip 压缩并设置 Content-Encoding: gzip，
+// 签名针对压缩后实际发送的字节。响应无论是否开启都会按 Content-Encoding 自动解压。
+func WithGzip(enable bool) Option {
+	return func(c *Client) {
+		c.gzip = enable
+	}
+}
+
+// WithMaxResponseBytes 设置解压后响应体的上限，默认 DefaultMaxResponseBytes
+func WithMaxResponseBytes(n int64) Option {
+	return func(c *Client) {
+		c.maxResponseBytes = n
+	}
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readBody 按 Content-Encoding 解压并读取最多 limit 字节，超过时返回 ErrResponseTooLarge 和已读到的部分。
+// 压缩格式错误返回 *DecodeError，读连接失败返回 *TransportError。
+func readBody(resp *http.Response, limit int64) ([]byte, error) {
+	var r io.Reader = resp.Body
+	switch ce := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); ce {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, gzipError(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, &DecodeError{Err: fmt.Errorf("unsupported content encoding %q", ce)}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return body, gzipError(err)
+	}
+	if int64(len(body)) > limit {
+		return body[:limit], ErrResponseTooLarge
+	}
+
+	return body, nil
+}
+
+func gzipError(err error) error {
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) {
+		return &DecodeError{Err: err}
+	}
+	return &TransportError{Err: err}
+}
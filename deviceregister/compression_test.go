@@ -0,0 +1,79 @@
+package deviceregister_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"do_some_fxxking_test/deviceregister/signing"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterGzip(t *testing.T) {
+	tests := []struct {
+		name     string
+		gzip     bool
+		encoding string
+	}{
+		{"plain", false, ""},
+		{"gzip", true, "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 签名针对实际发送的字节，服务端先验签再解压
+			s := mockserver.New()
+			s.Verifier = signing.NewVerifier(signing.Credentials{AppKey: "key", AppSecret: "secret"})
+			rec := &bodyRecorder{next: s}
+			ts := httptest.NewServer(rec)
+			defer ts.Close()
+
+			c := testClient(t, ts.URL, deviceregister.WithGzip(tt.gzip), deviceregister.WithCredentials("key", "secret"))
+			res, err := c.Register(context.Background(), testDevice())
+			if err != nil {
+				t.Fatalf("Register: %v", err)
+			}
+			if res.DeviceId == 0 {
+				t.Errorf("Register = %+v, want a device_id", res)
+			}
+
+			if len(rec.bodies) != 1 {
+				t.Fatalf("server got %d requests, want 1", len(rec.bodies))
+			}
+			if got := rec.headers[0].Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			body := rec.bodies[0]
+			if tt.gzip {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("request body is not gzip: %v", err)
+				}
+				if body, err = ioutil.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.HasPrefix(body, []byte(`{"header":`)) {
+				t.Errorf("request body = %s, want the JSON envelope", body)
+			}
+		})
+	}
+}
+
+func TestRegisterResponseBomb(t *testing.T) {
+	s, ts := mockserver.Start()
+	defer ts.Close()
+	s.Script(mockserver.Fault{Bomb: true})
+
+	c := testClient(t, ts.URL, deviceregister.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 1}))
+	_, err := c.Register(context.Background(), testDevice())
+	if !errors.Is(err, deviceregister.ErrResponseTooLarge) {
+		t.Fatalf("Register error = %v, want ErrResponseTooLarge", err)
+	}
+	if k := deviceregister.KindOf(err); k != deviceregister.KindMalformedResponse {
+		t.Errorf("KindOf = %v, want %v", k, deviceregister.KindMalformedResponse)
+	}
+}
@@ -0,0 +1,481 @@
+package deviceregister
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EnvConfig   = "DEVICE_REGISTER_CONFIG"
+	EnvEndpoint = "DEVICE_REGISTER_ENDPOINT"
+	// EnvEndpoints 是逗号分隔的多个地址
+	EnvEndpoints = "DEVICE_REGISTER_ENDPOINTS"
+	EnvBalancer  = "DEVICE_REGISTER_BALANCER"
+	EnvHost      = "DEVICE_REGISTER_HOST"
+	EnvTimeout   = "DEVICE_REGISTER_TIMEOUT"
+	EnvAttempts  = "DEVICE_REGISTER_MAX_ATTEMPTS"
+	// EnvUDIDNamespace 是密钥，只能通过配置文件或环境变量设置，不提供命令行参数
+	EnvUDIDNamespace = "DEVICE_REGISTER_UDID_NAMESPACE"
+	EnvRedaction     = "DEVICE_REGISTER_REDACTION"
+	// EnvRedactionSalt 同样只能通过配置文件或环境变量设置
+	EnvRedactionSalt = "DEVICE_REGISTER_REDACTION_SALT"
+	EnvDebugPayloads = "DEVICE_REGISTER_DEBUG_PAYLOADS"
+	EnvBreaker       = "DEVICE_REGISTER_CIRCUIT_BREAKER"
+	EnvAppKey        = "DEVICE_REGISTER_APP_KEY"
+	EnvGzip          = "DEVICE_REGISTER_GZIP"
+	// EnvAppSecret 是密钥，只能通过配置文件或环境变量设置
+	EnvAppSecret = "DEVICE_REGISTER_APP_SECRET"
+)
+
+// Config 是 Client 的外部配置，优先级从低到高依次为：
+// 默认值 < 配置文件（-config 或 DEVICE_REGISTER_CONFIG）< 环境变量 < 命令行参数
+//
+// 配置文件为 JSON，例如：
+//
+//	{"endpoint": "http://10.0.0.1/service/2/device_register/", "host": "snssdk.vpc.com", "timeout": "10s"}
+type Config struct {
+	Endpoint string `json:"endpoint"`
+	// Endpoints 不为空时覆盖 Endpoint，Balancer 为 round_robin 或 least_in_flight
+	Endpoints []string `json:"endpoints"`
+	Balancer  string   `json:"balancer"`
+	// HealthCheck 不为 nil 时开启主动探测
+	HealthCheck *HealthCheckConfig `json:"health_check"`
+	Host        string             `json:"host"`
+	Timeout     Duration           `json:"timeout"`
+	// MaxAttempts 为 0 时使用 DefaultRetryPolicy 的次数
+	MaxAttempts int `json:"max_attempts"`
+	// UDIDNamespace 不为空时使用 WithDeterministicUDID
+	UDIDNamespace string `json:"udid_namespace"`
+	// Redaction 为 hash、mask 或 none，默认 hash
+	Redaction     string `json:"redaction"`
+	RedactionSalt string `json:"redaction_salt"`
+	DebugPayloads bool   `json:"debug_payloads"`
+	// AppKey 和 AppSecret 都不为空时对请求签名
+	AppKey    string `json:"app_key"`
+	AppSecret string `json:"app_secret"`
+	// Gzip 开启请求体压缩；MaxResponseBytes 是解压后响应体的上限，为 0 时使用默认值
+	Gzip             bool  `json:"gzip"`
+	MaxResponseBytes int64 `json:"max_response_bytes"`
+	// TLS 和 Proxy 不为 nil 时分别使用 WithTLS 和 WithProxy
+	TLS   *TLSConfig   `json:"tls"`
+	Proxy *ProxyConfig `json:"proxy"`
+	// CircuitBreaker 不为 nil 时启用熔断
+	CircuitBreaker *BreakerConfig `json:"circuit_breaker"`
+}
+
+// BreakerConfig 对应 BreakerPolicy，为 0 的字段使用 DefaultBreakerPolicy 的值，例如：
+//
+//	{"circuit_breaker": {"consecutive_failures": 3, "cool_down": "10s"}}
+type BreakerConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	FailureRatio        float64  `json:"failure_ratio"`
+	MinRequests         int      `json:"min_requests"`
+	Window              Duration `json:"window"`
+	CoolDown            Duration `json:"cool_down"`
+	HalfOpenRequests    int      `json:"half_open_requests"`
+}
+
+// HealthCheckConfig 对应 HealthCheck，例如：
+//
+//	{"health_check": {"interval": "10s", "timeout": "2s", "path": "/ping"}}
+type HealthCheckConfig struct {
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+	Path     string   `json:"path"`
+}
+
+func (bc BreakerConfig) policy() BreakerPolicy {
+	p := DefaultBreakerPolicy()
+	if bc.ConsecutiveFailures != 0 {
+		p.ConsecutiveFailures = bc.ConsecutiveFailures
+	}
+	if bc.FailureRatio != 0 {
+		p.FailureRatio = bc.FailureRatio
+	}
+	if bc.MinRequests != 0 {
+		p.MinRequests = bc.MinRequests
+	}
+	if bc.Window != 0 {
+		p.Window = time.Duration(bc.Window)
+	}
+	if bc.CoolDown != 0 {
+		p.CoolDown = time.Duration(bc.CoolDown)
+	}
+	if bc.HalfOpenRequests != 0 {
+		p.HalfOpenRequests = bc.HalfOpenRequests
+	}
+
+	return p
+}
+
+// Duration 在 JSON 中使用 time.ParseDuration 的格式，如 "1.5s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Endpoint: DefaultEndpoint,
+		Host:     DefaultHost,
+		Timeout:  Duration(DefaultTimeout),
+	}
+}
+
+// LoadConfig 在 fs 上注册 -config、-endpoint、-host、-timeout 并解析 args，
+// 然后按优先级合并配置文件、环境变量和命令行参数。
+// 调用方可以在此之前向 fs 注册自己的参数。
+func LoadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	var (
+		path     = fs.String("config", "", "JSON config file, overrides $"+EnvConfig)
+		endpoint = fs.String("endpoint", "", "device_register URL, overrides $"+EnvEndpoint)
+		multi    = fs.String("endpoints", "", "comma separated device_register URLs, overrides $"+EnvEndpoints)
+		balancer = fs.String("balancer", "", "round_robin or least_in_flight, overrides $"+EnvBalancer)
+		host     = fs.String("host", "", "Host header, overrides $"+EnvHost)
+		timeout  = fs.Duration("timeout", 0, "per request timeout, overrides $"+EnvTimeout)
+		attempts = fs.Int("max-attempts", 0, "max attempts including the first one, overrides $"+EnvAttempts)
+		redact   = fs.String("redaction", "", "hash, mask or none for user identifiers in logs, overrides $"+EnvRedaction)
+		debug    = fs.Bool("debug-payloads", false, "log full request and response bodies, overrides $"+EnvDebugPayloads)
+		appKey   = fs.String("app-key", "", "app key for request signing, overrides $"+EnvAppKey)
+		gzip     = fs.Bool("gzip", false, "gzip request bodies, overrides $"+EnvGzip)
+		caFile   = fs.String("tls-ca", "", "PEM CA bundle for https endpoints")
+		certFile = fs.String("tls-cert", "", "client certificate for mTLS, requires -tls-key")
+		keyFile  = fs.String("tls-key", "", "client private key for mTLS, requires -tls-cert")
+		minTLS   = fs.String("tls-min-version", "", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+		sni      = fs.String("tls-server-name", "", "server name for SNI and certificate verification")
+		proxy    = fs.String("proxy", "", "egress proxy URL, none to disable proxies from the environment")
+		noProxy  = fs.String("no-proxy", "", "comma separated hosts, domains and CIDRs that bypass -proxy")
+		breaker  = fs.Bool("circuit-breaker", false, "enable the circuit breaker, overrides $"+EnvBreaker)
+	)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := DefaultConfig()
+
+	file := os.Getenv(EnvConfig)
+	if *path != "" {
+		file = *path
+	}
+	if file != "" {
+		if err := cfg.loadFile(file); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return Config{}, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "endpoint":
+			cfg.Endpoint, cfg.Endpoints = *endpoint, nil
+		case "endpoints":
+			cfg.Endpoints = splitList(*multi)
+		case "balancer":
+			cfg.Balancer = *balancer
+		case "host":
+			cfg.Host = *host
+		case "timeout":
+			cfg.Timeout = Duration(*timeout)
+		case "max-attempts":
+			cfg.MaxAttempts = *attempts
+		case "redaction":
+			cfg.Redaction = *redact
+		case "debug-payloads":
+			cfg.DebugPayloads = *debug
+		case "app-key":
+			cfg.AppKey = *appKey
+		case "gzip":
+			cfg.Gzip = *gzip
+		case "tls-ca":
+			cfg.tlsConfig().CAFile = *caFile
+		case "tls-cert":
+			cfg.tlsConfig().CertFile = *certFile
+		case "tls-key":
+			cfg.tlsConfig().KeyFile = *keyFile
+		case "tls-min-version":
+			cfg.tlsConfig().MinVersion = *minTLS
+		case "tls-server-name":
+			cfg.tlsConfig().ServerName = *sni
+		case "proxy":
+			cfg.proxyConfig().URL = *proxy
+			if *proxy == "none" {
+				cfg.Proxy.URL = ""
+			}
+		case "no-proxy":
+			cfg.proxyConfig().NoProxy = splitList(*noProxy)
+		case "circuit-breaker":
+			cfg.enableBreaker(*breaker)
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("deviceregister: read config %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("deviceregister: parse config %s: %v", path, err)
+	}
+
+	return nil
+}
+
+func (cfg *Config) loadEnv() error {
+	if v, ok := os.LookupEnv(EnvEndpoint); ok {
+		cfg.Endpoint, cfg.Endpoints = v, nil
+	}
+	if v, ok := os.LookupEnv(EnvEndpoints); ok {
+		cfg.Endpoints = splitList(v)
+	}
+	if v, ok := os.LookupEnv(EnvBalancer); ok {
+		cfg.Balancer = v
+	}
+	if v, ok := os.LookupEnv(EnvHost); ok {
+		cfg.Host = v
+	}
+	if v, ok := os.LookupEnv(EnvTimeout); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("deviceregister: invalid $%s %q: %v", EnvTimeout, v, err)
+		}
+		cfg.Timeout = Duration(d)
+	}
+	if v, ok := os.LookupEnv(EnvAttempts); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("deviceregister: invalid $%s %q: %v", EnvAttempts, v, err)
+		}
+		cfg.MaxAttempts = n
+	}
+	if v, ok := os.LookupEnv(EnvUDIDNamespace); ok {
+		cfg.UDIDNamespace = v
+	}
+	if v, ok := os.LookupEnv(EnvRedaction); ok {
+		cfg.Redaction = v
+	}
+	if v, ok := os.LookupEnv(EnvRedactionSalt); ok {
+		cfg.RedactionSalt = v
+	}
+	if v, ok := os.LookupEnv(EnvDebugPayloads); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("deviceregister: invalid $%s %q: %v", EnvDebugPayloads, v, err)
+		}
+		cfg.DebugPayloads = b
+	}
+	if v, ok := os.LookupEnv(EnvAppKey); ok {
+		cfg.AppKey = v
+	}
+	if v, ok := os.LookupEnv(EnvAppSecret); ok {
+		cfg.AppSecret = v
+	}
+	if v, ok := os.LookupEnv(EnvGzip); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("deviceregister: invalid $%s %q: %v", EnvGzip, v, err)
+		}
+		cfg.Gzip = b
+	}
+	if v, ok := os.LookupEnv(EnvBreaker); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("deviceregister: invalid $%s %q: %v", EnvBreaker, v, err)
+		}
+		cfg.enableBreaker(b)
+	}
+
+	return nil
+}
+
+// tlsConfig 返回 cfg.TLS，为 nil 时先创建，命令行参数在配置文件的基础上逐项覆盖
+func (cfg *Config) tlsConfig() *TLSConfig {
+	if cfg.TLS == nil {
+		cfg.TLS = &TLSConfig{}
+	}
+	return cfg.TLS
+}
+
+func (cfg *Config) proxyConfig() *ProxyConfig {
+	if cfg.Proxy == nil {
+		cfg.Proxy = &ProxyConfig{}
+	}
+	return cfg.Proxy
+}
+
+// enableBreaker 开启时保留配置文件中的熔断参数
+func (cfg *Config) enableBreaker(enable bool) {
+	switch {
+	case !enable:
+		cfg.CircuitBreaker = nil
+	case cfg.CircuitBreaker == nil:
+		cfg.CircuitBreaker = &BreakerConfig{}
+	}
+}
+
+// Validate 检查配置是否合法
+func (cfg Config) Validate() error {
+	if len(cfg.Endpoints) == 0 {
+		if err := validateEndpoint(cfg.Endpoint); err != nil {
+			return err
+		}
+	}
+	for _, endpoint := range cfg.Endpoints {
+		if err := validateEndpoint(endpoint); err != nil {
+			return err
+		}
+	}
+	if _, err := ParseBalancer(cfg.Balancer); err != nil {
+		return err
+	}
+	if hc := cfg.HealthCheck; hc != nil {
+		if err := hc.healthCheck().validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateHost(cfg.Host); err != nil {
+		return err
+	}
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("deviceregister: timeout must not be negative, got %v", time.Duration(cfg.Timeout))
+	}
+	if cfg.MaxAttempts < 0 {
+		return fmt.Errorf("deviceregister: max_attempts must not be negative, got %d", cfg.MaxAttempts)
+	}
+	if _, err := ParseRedaction(cfg.Redaction); err != nil {
+		return err
+	}
+	if cfg.MaxResponseBytes < 0 {
+		return fmt.Errorf("deviceregister: max_response_bytes must not be negative, got %d", cfg.MaxResponseBytes)
+	}
+	if (cfg.AppKey == "") != (cfg.AppSecret == "") {
+		return errors.New("deviceregister: app_key and app_secret must both be set")
+	}
+	if cfg.CircuitBreaker != nil {
+		if err := cfg.CircuitBreaker.policy().validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Options 把配置转换为 NewClient 的参数
+func (cfg Config) Options() []Option {
+	opts := []Option{
+		WithEndpoint(cfg.Endpoint),
+		WithHost(cfg.Host),
+		WithTimeout(time.Duration(cfg.Timeout)),
+	}
+	if len(cfg.Endpoints) > 0 {
+		// Validate 已经检查过 Balancer
+		b, _ := ParseBalancer(cfg.Balancer)
+		opts = append(opts, WithEndpoints(cfg.Endpoints...), WithBalancer(b))
+	}
+	if cfg.HealthCheck != nil {
+		opts = append(opts, WithHealthCheck(cfg.HealthCheck.healthCheck()))
+	}
+	if cfg.MaxAttempts > 0 {
+		p := DefaultRetryPolicy()
+		p.MaxAttempts = cfg.MaxAttempts
+		opts = append(opts, WithRetryPolicy(p))
+	}
+	if cfg.UDIDNamespace != "" {
+		opts = append(opts, WithDeterministicUDID(cfg.UDIDNamespace))
+	}
+	// Validate 已经检查过 Redaction
+	r, _ := ParseRedaction(cfg.Redaction)
+	opts = append(opts, WithRedaction(r, cfg.RedactionSalt), WithDebugPayloads(cfg.DebugPayloads))
+	opts = append(opts, WithGzip(cfg.Gzip))
+	if cfg.MaxResponseBytes > 0 {
+		opts = append(opts, WithMaxResponseBytes(cfg.MaxResponseBytes))
+	}
+	if cfg.TLS != nil {
+		opts = append(opts, WithTLS(*cfg.TLS))
+	}
+	if cfg.Proxy != nil {
+		opts = append(opts, WithProxy(*cfg.Proxy))
+	}
+	if cfg.AppKey != "" {
+		opts = append(opts, WithCredentials(cfg.AppKey, cfg.AppSecret))
+	}
+	if cfg.CircuitBreaker != nil {
+		opts = append(opts, WithCircuitBreaker(cfg.CircuitBreaker.policy()))
+	}
+
+	return opts
+}
+
+func validateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return errors.New("deviceregister: endpoint is empty")
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("deviceregister: invalid endpoint %q: %v", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("deviceregister: endpoint %q must use http or https", endpoint)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("deviceregister: endpoint %q has no host", endpoint)
+	}
+
+	return nil
+}
+
+func (hc HealthCheckConfig) healthCheck() HealthCheck {
+	return HealthCheck{Interval: time.Duration(hc.Interval), Timeout: time.Duration(hc.Timeout), Path: hc.Path}
+}
+
+// splitList 按逗号切分并去掉空白和空项
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func validateHost(host string) error {
+	if strings.ContainsAny(host, " /\t\r\n") {
+		return fmt.Errorf("deviceregister: invalid host %q", host)
+	}
+
+	return nil
+}
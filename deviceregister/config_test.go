@@ -0,0 +1,196 @@
+package deviceregister_test
+
+import (
+	"do_some_fxxking_test/deviceregister"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv 设置 env 中的环境变量并清空其他 DEVICE_REGISTER_ 变量，测试结束后恢复
+func setenv(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	saved := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 && strings.HasPrefix(kv, "DEVICE_REGISTER_") {
+			saved[kv[:i]] = kv[i+1:]
+			os.Unsetenv(kv[:i])
+		}
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	t.Cleanup(func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+		for k, v := range saved {
+			os.Setenv(k, v)
+		}
+	})
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadConfig(t *testing.T, file string, env map[string]string, args ...string) (deviceregister.Config, error) {
+	t.Helper()
+
+	setenv(t, env)
+	if file != "" {
+		args = append([]string{"-config", writeConfig(t, file)}, args...)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return deviceregister.LoadConfig(fs, args)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	const file = `{"endpoint": "http://file/service/2/device_register/", "host": "file.host", "timeout": "1s", "max_attempts": 2}`
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		args     []string
+		endpoint string
+		host     string
+		timeout  time.Duration
+		attempts int
+	}{
+		{
+			name:     "defaults",
+			endpoint: deviceregister.DefaultEndpoint,
+			host:     deviceregister.DefaultHost,
+			timeout:  deviceregister.DefaultTimeout,
+		},
+		{
+			name:     "file",
+			file:     file,
+			endpoint: "http://file/service/2/device_register/",
+			host:     "file.host",
+			timeout:  time.Second,
+			attempts: 2,
+		},
+		{
+			name:     "env over file",
+			file:     file,
+			env:      map[string]string{deviceregister.EnvHost: "env.host", deviceregister.EnvTimeout: "2s"},
+			endpoint: "http://file/service/2/device_register/",
+			host:     "env.host",
+			timeout:  2 * time.Second,
+			attempts: 2,
+		},
+		{
+			name:     "flag over env",
+			file:     file,
+			env:      map[string]string{deviceregister.EnvHost: "env.host", deviceregister.EnvTimeout: "2s"},
+			args:     []string{"-timeout", "3s", "-max-attempts", "5"},
+			endpoint: "http://file/service/2/device_register/",
+			host:     "env.host",
+			timeout:  3 * time.Second,
+			attempts: 5,
+		},
+		{
+			name:     "empty env value overrides",
+			file:     file,
+			env:      map[string]string{deviceregister.EnvHost: ""},
+			endpoint: "http://file/service/2/device_register/",
+			timeout:  time.Second,
+			attempts: 2,
+		},
+		{
+			name:     "endpoint from env and flag",
+			env:      map[string]string{deviceregister.EnvEndpoint: "http://env/service/2/device_register/"},
+			args:     []string{"-host", "flag.host"},
+			endpoint: "http://env/service/2/device_register/",
+			host:     "flag.host",
+			timeout:  deviceregister.DefaultTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(t, tt.file, tt.env, tt.args...)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if cfg.Endpoint != tt.endpoint || cfg.Host != tt.host || time.Duration(cfg.Timeout) != tt.timeout || cfg.MaxAttempts != tt.attempts {
+				t.Errorf("config = %s %q %v %d, want %s %q %v %d",
+					cfg.Endpoint, cfg.Host, time.Duration(cfg.Timeout), cfg.MaxAttempts,
+					tt.endpoint, tt.host, tt.timeout, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	envFile := writeConfig(t, `{"host": "env-file.host"}`)
+	cfg, err := loadConfig(t, "", map[string]string{deviceregister.EnvConfig: envFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "env-file.host" {
+		t.Errorf("host = %q, want it from $%s", cfg.Host, deviceregister.EnvConfig)
+	}
+
+	// -config 覆盖环境变量指定的文件
+	cfg, err = loadConfig(t, `{"host": "flag-file.host"}`, map[string]string{deviceregister.EnvConfig: envFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "flag-file.host" {
+		t.Errorf("host = %q, want it from -config", cfg.Host)
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{name: "endpoint scheme", args: []string{"-endpoint", "ftp://10.0.0.1/"}, want: "must use http or https"},
+		{name: "endpoint without host", args: []string{"-endpoint", "http:///service/2/device_register/"}, want: "has no host"},
+		{name: "endpoint not a url", args: []string{"-endpoint", "http://[::1"}, want: "invalid endpoint"},
+		{name: "empty endpoint", file: `{"endpoint": ""}`, want: "endpoint is empty"},
+		{name: "one of endpoints", args: []string{"-endpoints", "http://a/, b"}, want: "must use http or https"},
+		{name: "host", args: []string{"-host", "a host"}, want: "invalid host"},
+		{name: "negative timeout flag", args: []string{"-timeout", "-1s"}, want: "timeout must not be negative"},
+		{name: "negative timeout file", file: `{"timeout": "-5s"}`, want: "timeout must not be negative"},
+		{name: "timeout env", env: map[string]string{deviceregister.EnvTimeout: "soon"}, want: deviceregister.EnvTimeout},
+		{name: "timeout not a string", file: `{"timeout": 30}`, want: "duration must be a string"},
+		{name: "negative attempts", file: `{"max_attempts": -1}`, want: "max_attempts must not be negative"},
+		{name: "attempts env", env: map[string]string{deviceregister.EnvAttempts: "three"}, want: deviceregister.EnvAttempts},
+		{name: "redaction", args: []string{"-redaction", "blur"}, want: "redaction"},
+		{name: "app key without secret", args: []string{"-app-key", "key"}, want: "app_key and app_secret"},
+		{name: "invalid json", file: `{"host": `, want: "parse config"},
+		{name: "missing file", args: []string{"-config", "/nonexistent/config.json"}, want: "read config"},
+		{name: "unknown flag", args: []string{"-hots", "x"}, want: "flag provided but not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(t, tt.file, tt.env, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadConfig error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Package deviceregister 封装私有化环境下的 device_register 接口，
+// 根据 user_unique_id 和 app_id 注册 device_id。
+package deviceregister
+
+import (
+	"context"
+)
+
+type DeviceRegister struct {
+	UserUniqueId string `json:"user_unique_id"`
+	AppId        uint32 `json:"app_id"`
+	Os           string `json:"os"`
+	// Profile 为 nil 时只发送 aid、user_unique_id、os 和设备标识
+	Profile *Profile `json:"profile,omitempty"`
+}
+
+// Response 是 device_register 接口的返回，各版本服务端的字段类型差异由 decodeResponse 兼容
+type Response struct {
+	DeviceId     uint64 `json:"device_id"`
+	InstallId    uint64 `json:"install_id"`
+	BdDid        string `json:"bd_did"`
+	Cd           string `json:"cd"`
+	InstallIdStr string `json:"install_id_str"`
+	NewUser      uint8  `json:"new_user"`
+	Ssid         string `json:"ssid"`
+	ServerTime   uint64 `json:"server_time"`
+}
+
+// Registrar 是注册能力的抽象，*Client 实现了它，批量注册和网关都依赖它而不是具体的 Client
+type Registrar interface {
+	Register(ctx context.Context, dr DeviceRegister) (*Response, error)
+}
+
+// RegisterDeviceId 使用默认 Client 注册，只返回 bd_did
+func (dr DeviceRegister) RegisterDeviceId() (string, error) {
+	c, err := NewClient()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := c.Register(context.Background(), dr)
+	if err != nil {
+		return "", err
+	}
+
+	return res.BdDid, nil
+}
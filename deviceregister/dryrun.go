@@ -0,0 +1,189 @@
+package deviceregister
+
+import (
+	"bytes"
+	"do_some_fxxking_test/deviceregister/signing"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maskedValue 替换 dry-run 输出中的签名等敏感值
+const maskedValue = "***"
+
+// PreparedRequest 是 DryRun 构造出的请求，与 Register 第一次尝试实际发送的请求一致
+type PreparedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Host 是覆盖的 Host 头，为空时使用 URL 中的 host
+	Host   string            `json:"host,omitempty"`
+	Header map[string]string `json:"header"`
+	// Body 是压缩前的请求体，Gzip 为 true 时实际发送的是它的 gzip
+	Body json.RawMessage `json:"body"`
+	Gzip bool            `json:"gzip,omitempty"`
+
+	// 以下字段只用于生成 curl 命令
+	payload []byte
+	tls     *TLSConfig
+	proxy   string
+}
+
+// DryRun 构造 Register 会发送的请求但不发送，用于排查私有化部署的问题。
+// URL 是 endpoint 池此时会为第一次尝试选择的 endpoint，重试和 failover 可能换到其他 endpoint。
+// 签名请求头和代理地址中的密码默认替换为 ***，reveal 为 true 时保留原值，
+// 此时签名只在 signing.DefaultMaxSkew 内有效，且 udid 每次随机生成（WithDeterministicUDID 时除外）。
+func (c *Client) DryRun(dr DeviceRegister, reveal bool) (*PreparedRequest, error) {
+	p, err := dr.platform()
+	if err != nil {
+		return nil, err
+	}
+	udid, err := c.udid(dr)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(dr.generateBody(p, udid))
+	if err != nil {
+		return nil, err
+	}
+	payload := body
+	if c.gzip {
+		if payload, err = gzipBody(body); err != nil {
+			return nil, err
+		}
+	}
+
+	// 只查看不选择，避免影响负载均衡的状态
+	req, err := http.NewRequest("POST", c.pool.peek(time.Now()).url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	c.setHeaders(req, dr.AppId, payload)
+
+	pr := &PreparedRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Host:   c.host,
+		Header: make(map[string]string, len(req.Header)),
+		Gzip:   c.gzip,
+
+		payload: payload,
+		tls:     c.tls,
+	}
+	for k := range req.Header {
+		v := req.Header.Get(k)
+		if k == signing.HeaderSignature && !reveal {
+			v = maskedValue
+		}
+		pr.Header[k] = v
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, body, "", "  "); err != nil {
+		return nil, err
+	}
+	pr.Body = pretty.Bytes()
+
+	if c.proxy != nil && c.proxy.URL != "" {
+		pr.proxy = c.proxy.URL
+		if u, err := url.Parse(c.proxy.URL); err == nil && !reveal {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), maskedValue)
+				// 保持 *** 可读，不做百分号编码
+				pr.proxy = strings.Replace(u.String(), url.PathEscape(maskedValue), maskedValue, 1)
+			}
+		}
+	}
+
+	return pr, nil
+}
+
+// JSON 返回缩进格式的请求
+func (r *PreparedRequest) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// Curl 返回等价的 curl 命令，参数都用单引号转义，可以直接粘贴到 shell 中执行。
+// Gzip 为 true 时请求体以 base64 传给 curl，保证与签名时的压缩结果逐字节一致。
+// 设置了 TLSConfig.ServerName 时 URL 的主机名换成 ServerName，并用 --connect-to 连接原来的地址，
+// 这样 curl 发送的 SNI 和校验证书使用的主机名与 Client 相同。
+func (r *PreparedRequest) Curl() string {
+	var args []string
+	if r.Gzip {
+		args = append(args, "printf", shellQuote("%s"), shellQuote(base64.StdEncoding.EncodeToString(r.payload)), "|", "base64", "-d", "|")
+	}
+	rawURL, connectTo := r.URL, ""
+	if r.tls != nil && r.tls.ServerName != "" {
+		rawURL, connectTo = rewriteServerName(r.URL, r.tls.ServerName)
+	}
+	args = append(args, "curl", "-sS", "-X", r.Method, shellQuote(rawURL))
+	if connectTo != "" {
+		args = append(args, "--connect-to", shellQuote(connectTo))
+	}
+
+	if r.Host != "" {
+		args = append(args, "-H", shellQuote("Host: "+r.Host))
+	}
+	keys := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-H", shellQuote(k+": "+r.Header[k]))
+	}
+	// 请求头里声明了 gzip，让 curl 负责解压响应
+	args = append(args, "--compressed")
+
+	if r.tls != nil {
+		if r.tls.CAFile != "" {
+			args = append(args, "--cacert", shellQuote(r.tls.CAFile))
+		}
+		if r.tls.CertFile != "" {
+			args = append(args, "--cert", shellQuote(r.tls.CertFile), "--key", shellQuote(r.tls.KeyFile))
+		}
+		if r.tls.MinVersion != "" {
+			args = append(args, "--tlsv"+r.tls.MinVersion)
+		}
+	}
+	if r.proxy != "" {
+		args = append(args, "-x", shellQuote(r.proxy))
+	}
+
+	if r.Gzip {
+		args = append(args, "--data-binary", "@-")
+	} else {
+		args = append(args, "--data-binary", shellQuote(string(r.payload)))
+	}
+
+	return strings.Join(args, " ")
+}
+
+// rewriteServerName 把 https URL 的主机名换成 serverName，返回新的 URL 和 --connect-to 的参数，
+// 不是 https 或主机名已经是 serverName 时原样返回
+func rewriteServerName(rawURL, serverName string) (string, string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || strings.EqualFold(u.Hostname(), serverName) {
+		return rawURL, ""
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u.Host = net.JoinHostPort(serverName, port)
+
+	return u.String(), serverName + ":" + port + ":" + host + ":" + port
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,377 @@
+package deviceregister
+
+import (
+	"code.byted.org/gopkg/logs"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balancer 决定每次注册使用哪个 endpoint
+type Balancer int
+
+const (
+	// RoundRobin 按顺序轮流使用
+	RoundRobin Balancer = iota
+	// LeastInFlight 使用进行中请求最少的，相同时轮流使用
+	LeastInFlight
+)
+
+func (b Balancer) String() string {
+	switch b {
+	case RoundRobin:
+		return "round_robin"
+	case LeastInFlight:
+		return "least_in_flight"
+	default:
+		return fmt.Sprintf("Balancer(%d)", int(b))
+	}
+}
+
+func ParseBalancer(s string) (Balancer, error) {
+	switch strings.ToLower(s) {
+	case "round_robin", "":
+		return RoundRobin, nil
+	case "least_in_flight":
+		return LeastInFlight, nil
+	default:
+		return 0, fmt.Errorf("deviceregister: unknown balancer %q, expect round_robin or least_in_flight", s)
+	}
+}
+
+// OutlierPolicy 控制被动摘除：一个 endpoint 连续失败后暂时不再使用。
+// 失败的判定与熔断器相同，只有网络错误和 5xx。
+type OutlierPolicy struct {
+	// ConsecutiveFailures 是连续失败多少次后摘除，为 0 时不摘除
+	ConsecutiveFailures int
+	// EjectionTime 是第一次摘除的时长，之后连续摘除每次翻倍
+	EjectionTime time.Duration
+	// MaxEjectionTime 是摘除时长的上限
+	MaxEjectionTime time.Duration
+}
+
+func DefaultOutlierPolicy() OutlierPolicy {
+	return OutlierPolicy{
+		ConsecutiveFailures: 3,
+		EjectionTime:        time.Second * 30,
+		MaxEjectionTime:     time.Minute * 5,
+	}
+}
+
+// HealthCheck 是主动探测的配置，对每个 endpoint 定期发 GET 请求，
+// 连接失败或返回 5xx 时标记为不健康，直到下一次探测成功
+type HealthCheck struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// Path 不为空时替换 endpoint 的路径，为空时直接请求 endpoint
+	Path string
+}
+
+// WithEndpoints 设置多个 device_register 地址，覆盖 WithEndpoint。
+// 所有地址共用 WithHost 设置的 Host 头。
+func WithEndpoints(endpoints ...string) Option {
+	return func(c *Client) {
+		c.endpoints = endpoints
+	}
+}
+
+// WithBalancer 设置多个 endpoint 之间的选择方式，默认 RoundRobin
+func WithBalancer(b Balancer) Option {
+	return func(c *Client) {
+		c.balancer = b
+	}
+}
+
+// WithOutlierPolicy 设置被动摘除，默认使用 DefaultOutlierPolicy
+func WithOutlierPolicy(p OutlierPolicy) Option {
+	return func(c *Client) {
+		c.outlier = p
+	}
+}
+
+// WithHealthCheck 开启主动探测，需要调用 Client.Close 停止
+func WithHealthCheck(hc HealthCheck) Option {
+	return func(c *Client) {
+		c.healthCheck = &hc
+	}
+}
+
+func (p OutlierPolicy) validate() error {
+	if p.ConsecutiveFailures < 0 {
+		return fmt.Errorf("deviceregister: outlier consecutive failures must not be negative, got %d", p.ConsecutiveFailures)
+	}
+	if p.ConsecutiveFailures > 0 && (p.EjectionTime <= 0 || p.MaxEjectionTime < p.EjectionTime) {
+		return fmt.Errorf("deviceregister: invalid outlier ejection time %v, max %v", p.EjectionTime, p.MaxEjectionTime)
+	}
+
+	return nil
+}
+
+func (hc HealthCheck) validate() error {
+	if hc.Interval <= 0 || hc.Timeout <= 0 {
+		return fmt.Errorf("deviceregister: health check interval and timeout must be positive, got %v and %v", hc.Interval, hc.Timeout)
+	}
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		return fmt.Errorf("deviceregister: health check path %q must start with /", hc.Path)
+	}
+
+	return nil
+}
+
+type endpoint struct {
+	url      string
+	inFlight int
+
+	consecutive  int
+	ejections    int
+	ejectedUntil time.Time
+	unhealthy    bool
+}
+
+func (e *endpoint) available(now time.Time) bool {
+	return !e.unhealthy && !now.Before(e.ejectedUntil)
+}
+
+// endpointPool 在多个 endpoint 之间选择，并记录每个 endpoint 的失败
+type endpointPool struct {
+	balancer Balancer
+	outlier  OutlierPolicy
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	next      int
+}
+
+func newEndpointPool(urls []string, b Balancer, outlier OutlierPolicy) *endpointPool {
+	p := &endpointPool{balancer: b, outlier: outlier}
+	for _, u := range urls {
+		p.endpoints = append(p.endpoints, &endpoint{url: u})
+	}
+	return p
+}
+
+// pick 选择一个 endpoint 并计入进行中的请求，用完需要调用 done。
+// 优先选择没有用过且可用的，都不可用时忽略摘除，避免全部摘除后无法注册。
+func (p *endpointPool) pick(tried map[*endpoint]bool, now time.Time) *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := p.choose(func(e *endpoint) bool { return !tried[e] && e.available(now) })
+	if e == nil {
+		e = p.choose(func(e *endpoint) bool { return !tried[e] })
+	}
+	if e == nil {
+		e = p.choose(func(e *endpoint) bool { return true })
+	}
+	e.inFlight++
+
+	return e
+}
+
+// peek 返回 pick 此时会选择的 endpoint，不计入进行中的请求，也不改变轮询的位置
+func (p *endpointPool) peek(now time.Time) *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next := p.next
+	defer func() { p.next = next }()
+
+	e := p.choose(func(e *endpoint) bool { return e.available(now) })
+	if e == nil {
+		e = p.choose(func(e *endpoint) bool { return true })
+	}
+	return e
+}
+
+// choose 从 next 开始找第一个满足 ok 的，LeastInFlight 时找进行中请求最少的，调用方持有 mu
+func (p *endpointPool) choose(ok func(e *endpoint) bool) *endpoint {
+	var best *endpoint
+	n, bestIdx := len(p.endpoints), 0
+	for i := 0; i < n; i++ {
+		idx := (p.next + i) % n
+		e := p.endpoints[idx]
+		if !ok(e) {
+			continue
+		}
+		if best == nil || (p.balancer == LeastInFlight && e.inFlight < best.inFlight) {
+			best, bestIdx = e, idx
+		}
+		if p.balancer == RoundRobin {
+			break
+		}
+	}
+	if best != nil {
+		p.next = (bestIdx + 1) % n
+	}
+
+	return best
+}
+
+// done 记录一次请求的结果，返回这次失败是否导致 endpoint 被摘除以及摘除的时长
+func (p *endpointPool) done(e *endpoint, failed bool, now time.Time) (ejected time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.inFlight--
+	if !failed {
+		e.consecutive, e.ejections = 0, 0
+		return 0
+	}
+
+	e.consecutive++
+	// 只有一个 endpoint 时摘除没有意义，pick 总会忽略摘除选中它
+	if len(p.endpoints) == 1 || p.outlier.ConsecutiveFailures == 0 || e.consecutive < p.outlier.ConsecutiveFailures {
+		return 0
+	}
+
+	d := p.outlier.EjectionTime
+	for i := 0; i < e.ejections && d < p.outlier.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	if d > p.outlier.MaxEjectionTime {
+		d = p.outlier.MaxEjectionTime
+	}
+	e.consecutive = 0
+	e.ejections++
+	e.ejectedUntil = now.Add(d)
+
+	return d
+}
+
+// retain 在同一个 endpoint 上重试时重新计入进行中的请求
+func (p *endpointPool) retain(e *endpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.inFlight++
+}
+
+// release 归还没有结果的请求，如调用方取消了请求
+func (p *endpointPool) release(e *endpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.inFlight--
+}
+
+func (p *endpointPool) setHealthy(e *endpoint, healthy bool) (changed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changed = e.unhealthy == healthy
+	e.unhealthy = !healthy
+	return changed
+}
+
+// failoverSafe 判断换一个 endpoint 重试是否不会重复注册：
+// 请求体没有发出去，或者服务端明确表示没有处理（503、429）。
+// 其他情况服务端可能已经注册成功，只在同一个 endpoint 上重试，
+// 重试的请求体与第一次完全相同，由服务端按设备标识去重。
+func failoverSafe(err error, sent bool) bool {
+	if !sent {
+		return true
+	}
+
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusServiceUnavailable || se.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+// recordEndpoint 记录 endpoint 的结果，调用方取消或超时导致的失败不能说明 endpoint 的状态，不计入摘除
+func (c *Client) recordEndpoint(ctx context.Context, e *endpoint, err error) {
+	if err != nil && ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		c.pool.release(e)
+		return
+	}
+
+	if d := c.pool.done(e, breakerFailure(err), time.Now()); d > 0 {
+		c.metrics.Counter(MetricEjection, 1, map[string]string{"endpoint": e.url})
+		logs.CtxWarnKvs(ctx, "msg", "endpoint ejected", "endpoint", e.url, "duration", d)
+	}
+}
+
+// startHealthCheck 启动主动探测，Close 时停止
+func (c *Client) startHealthCheck() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopHealthCheck = cancel
+
+	for _, e := range c.pool.endpoints {
+		go c.probeLoop(ctx, e)
+	}
+}
+
+func (c *Client) probeLoop(ctx context.Context, e *endpoint) {
+	t := time.NewTicker(c.healthCheck.Interval)
+	defer t.Stop()
+
+	for {
+		err := c.probe(ctx, e.url)
+		if ctx.Err() != nil {
+			return
+		}
+		if c.pool.setHealthy(e, err == nil) {
+			if err != nil {
+				logs.CtxWarnKvs(ctx, "msg", "endpoint unhealthy", "endpoint", e.url, "err", err)
+			} else {
+				logs.CtxInfoKvs(ctx, "msg", "endpoint healthy again", "endpoint", e.url)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) probe(ctx context.Context, endpoint string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.healthCheck.Timeout)
+	defer cancel()
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if c.healthCheck.Path != "" {
+		u.Path, u.RawQuery = c.healthCheck.Path, ""
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.host != "" {
+		req.Host = c.host
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, bodyExcerptLimit))
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close 停止主动探测，没有开启时什么都不做
+func (c *Client) Close() error {
+	if c.stopHealthCheck != nil {
+		c.stopHealthCheck()
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package deviceregister_test
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"testing"
+	"time"
+)
+
+func TestCallerDeadlineNotCountedAsFailure(t *testing.T) {
+	s, ts := mockserver.Start()
+	defer ts.Close()
+	s.Script(mockserver.Fault{Latency: time.Second})
+
+	sink := deviceregister.NewMemorySink()
+	a, b := ts.URL+mockserver.Path+"?a", ts.URL+mockserver.Path+"?b"
+	c := testClient(t, ts.URL,
+		deviceregister.WithEndpoints(a, b),
+		deviceregister.WithOutlierPolicy(deviceregister.OutlierPolicy{ConsecutiveFailures: 1, EjectionTime: time.Minute, MaxEjectionTime: time.Minute}),
+		deviceregister.WithCircuitBreaker(deviceregister.BreakerPolicy{ConsecutiveFailures: 1, CoolDown: time.Minute, HalfOpenRequests: 1}),
+		deviceregister.WithMetrics(sink))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Register(ctx, testDevice()); err == nil {
+		t.Fatal("Register succeeded, want the caller deadline error")
+	}
+
+	for _, e := range []string{a, b} {
+		if n := sink.CounterValue(deviceregister.MetricEjection, map[string]string{"endpoint": e}); n != 0 {
+			t.Errorf("endpoint %s ejected %d times, want 0", e, n)
+		}
+	}
+	if n := sink.CounterValue(deviceregister.MetricBreakerState, map[string]string{"from": "closed", "to": "open"}); n != 0 {
+		t.Errorf("breaker opened %d times, want 0", n)
+	}
+	if _, err := c.Register(context.Background(), testDevice()); err != nil {
+		t.Errorf("Register after the deadline: %v", err)
+	}
+}
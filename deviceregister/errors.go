@@ -0,0 +1,141 @@
+package deviceregister
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 可以用 errors.Is 判断的错误类别
+var (
+	ErrTransport         = errors.New("deviceregister: transport failure")
+	ErrStatus            = errors.New("deviceregister: unexpected http status")
+	ErrMalformedResponse = errors.New("deviceregister: malformed response")
+	ErrEmptyIdentity     = errors.New("deviceregister: empty device identity")
+	ErrInvalidRequest    = errors.New("deviceregister: invalid request")
+)
+
+// bodyExcerptLimit 是错误中保留的响应体最大字节数
+const bodyExcerptLimit = 512
+
+// Kind 是错误的分类，方便调用方决定告警还是重试
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	KindTransport
+	KindStatus
+	KindMalformedResponse
+	KindEmptyIdentity
+	KindInvalidRequest
+	KindCircuitOpen
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindTransport:
+		return "transport"
+	case KindStatus:
+		return "status"
+	case KindMalformedResponse:
+		return "malformed_response"
+	case KindEmptyIdentity:
+		return "empty_identity"
+	case KindInvalidRequest:
+		return "invalid_request"
+	case KindCircuitOpen:
+		return "circuit_open"
+	default:
+		return "unknown"
+	}
+}
+
+// KindOf 返回 err 所属的类别，nil 或无法识别的错误返回 KindUnknown
+func KindOf(err error) Kind {
+	switch {
+	case err == nil:
+		return KindUnknown
+	// 先于 ErrTransport 判断，Transport 返回的 ErrInvalidRequest 也归为请求错误
+	case errors.Is(err, ErrInvalidRequest):
+		return KindInvalidRequest
+	case errors.Is(err, ErrTransport):
+		return KindTransport
+	case errors.Is(err, ErrStatus):
+		return KindStatus
+	case errors.Is(err, ErrMalformedResponse):
+		return KindMalformedResponse
+	case errors.Is(err, ErrEmptyIdentity):
+		return KindEmptyIdentity
+	case errors.Is(err, ErrCircuitOpen):
+		return KindCircuitOpen
+	default:
+		return KindUnknown
+	}
+}
+
+// TransportError 表示请求没有拿到完整的响应，如连接失败、超时、读响应体失败
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTransport, e.Err)
+}
+
+func (e *TransportError) Unwrap() error { return e.Err }
+
+func (e *TransportError) Is(target error) bool { return target == ErrTransport }
+
+// StatusError 表示 device_register 返回了非 2xx 的状态码
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	// Body 是响应体的前 512 字节
+	Body []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v %d: %q", ErrStatus, e.StatusCode, e.Body)
+}
+
+func (e *StatusError) Is(target error) bool { return target == ErrStatus }
+
+// DecodeError 表示 2xx 响应体不是合法的 JSON
+type DecodeError struct {
+	Err error
+	// Body 是响应体的前 512 字节
+	Body []byte
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v: %v: %q", ErrMalformedResponse, e.Err, e.Body)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+func (e *DecodeError) Is(target error) bool { return target == ErrMalformedResponse }
+
+// ValidationError 表示请求在发送前没有通过校验
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v: %s %s", ErrInvalidRequest, e.Field, e.Reason)
+}
+
+func (e *ValidationError) Is(target error) bool { return target == ErrInvalidRequest }
+
+// IsRetryable 判断一次失败是否值得重试：超时等网络错误、5xx 和 429。
+// 调用方自己的 ctx 超时产生的错误也会返回 true，需要先检查 ctx.Err()。
+func IsRetryable(err error) bool {
+	return retryable(err)
+}
+
+func excerpt(b []byte) []byte {
+	if len(b) > bodyExcerptLimit {
+		b = b[:bodyExcerptLimit]
+	}
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,70 @@
+package deviceregister_test
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want deviceregister.Kind
+	}{
+		{"nil", nil, deviceregister.KindUnknown},
+		{"plain", errors.New("boom"), deviceregister.KindUnknown},
+		{"transport", &deviceregister.TransportError{Err: errors.New("reset")}, deviceregister.KindTransport},
+		{"status", &deviceregister.StatusError{StatusCode: 503}, deviceregister.KindStatus},
+		{"decode", &deviceregister.DecodeError{Err: errors.New("eof")}, deviceregister.KindMalformedResponse},
+		{"empty identity", deviceregister.ErrEmptyIdentity, deviceregister.KindEmptyIdentity},
+		{"validation", &deviceregister.ValidationError{Field: "aid", Reason: "must not be zero"}, deviceregister.KindInvalidRequest},
+		{"circuit open", &deviceregister.CircuitOpenError{}, deviceregister.KindCircuitOpen},
+		{"wrapped", fmt.Errorf("register u1: %w", &deviceregister.StatusError{StatusCode: 429}), deviceregister.KindStatus},
+		{"queued", &deviceregister.QueuedError{Err: &deviceregister.TransportError{Err: errors.New("reset")}}, deviceregister.KindTransport},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deviceregister.KindOf(tt.err); got != tt.want {
+				t.Errorf("KindOf(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterErrorKinds(t *testing.T) {
+	tests := []struct {
+		name   string
+		fault  mockserver.Fault
+		want   deviceregister.Kind
+		status int
+	}{
+		{"bad request", mockserver.Fault{Status: http.StatusBadRequest}, deviceregister.KindStatus, http.StatusBadRequest},
+		{"unavailable", mockserver.Fault{Status: http.StatusServiceUnavailable, RetryAfter: "1"}, deviceregister.KindStatus, http.StatusServiceUnavailable},
+		{"malformed", mockserver.Fault{Malformed: true}, deviceregister.KindMalformedResponse, 0},
+		{"empty", mockserver.Fault{Empty: true}, deviceregister.KindEmptyIdentity, 0},
+		{"truncate", mockserver.Fault{Truncate: true}, deviceregister.KindTransport, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := mockserver.Start()
+			defer ts.Close()
+			s.Script(tt.fault)
+
+			c := testClient(t, ts.URL, deviceregister.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 1}))
+			_, err := c.Register(context.Background(), testDevice())
+			if got := deviceregister.KindOf(err); got != tt.want {
+				t.Fatalf("KindOf(%v) = %v, want %v", err, got, tt.want)
+			}
+
+			var se *deviceregister.StatusError
+			if tt.status != 0 && (!errors.As(err, &se) || se.StatusCode != tt.status) {
+				t.Errorf("Register error = %v, want status %d", err, tt.status)
+			}
+		})
+	}
+}
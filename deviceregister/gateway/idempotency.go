@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"do_some_fxxking_test/deviceregister"
+	"sync"
+	"time"
+)
+
+// idempotency 按 Idempotency-Key 合并请求：
+// 同一个 key 的并发请求只执行一次，成功的结果在 ttl 内直接复用；
+// 失败的结果不保留，之后用同一个 key 重试会重新执行。
+type idempotency struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*idemEntry
+	lastSweep time.Time
+}
+
+type idemEntry struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	res         *deviceregister.Response
+	err         error
+	expiresAt   time.Time
+}
+
+func newIdempotency(ttl time.Duration) *idempotency {
+	return &idempotency{ttl: ttl, entries: make(map[string]*idemEntry)}
+}
+
+// do 以 key 执行 fn。fingerprint 是请求体的摘要，同一个 key 对应不同请求体时返回 errKeyReused。
+// replayed 表示结果来自之前或并发的另一次执行。
+func (m *idempotency) do(key string, fingerprint [sha256.Size]byte, fn func() (*deviceregister.Response, error)) (res *deviceregister.Response, replayed bool, err error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	m.sweep(now)
+	if e, ok := m.entries[key]; ok && !e.expired(now) {
+		m.mu.Unlock()
+		if e.fingerprint != fingerprint {
+			return nil, false, errKeyReused
+		}
+		<-e.done
+		return e.res, true, e.err
+	}
+
+	e := &idemEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	m.entries[key] = e
+	m.mu.Unlock()
+
+	e.res, e.err = fn()
+
+	m.mu.Lock()
+	if e.err != nil {
+		delete(m.entries, key)
+	} else {
+		e.expiresAt = time.Now().Add(m.ttl)
+	}
+	m.mu.Unlock()
+	close(e.done)
+
+	return e.res, false, e.err
+}
+
+// sweep 每分钟最多清理一次过期的结果，调用方持有 mu
+func (m *idempotency) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+
+	for key, e := range m.entries {
+		if e.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// expired 只对已经完成的结果有意义，执行中的 expiresAt 为零值
+func (e *idemEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
@@ -0,0 +1,225 @@
+// Package gateway 把设备注册暴露为 JSON HTTP 接口，供非 Go 服务调用：
+//
+//	POST /register  {"user_unique_id": "...", "app_id": 10000012, "os": "ios"}
+//	GET  /healthz   进程存活
+//	GET  /readyz    可以接收流量，关闭过程中返回 503
+//
+// 设置 Server.Verifier 后调用方需要按 signing 包的约定签名。
+// POST /register 支持 Idempotency-Key 请求头，同一个 key 的并发或重复请求只注册一次，
+// 复用的结果带有 Idempotent-Replayed: true 响应头。
+package gateway
+
+import (
+	"code.byted.org/gopkg/logs"
+	"context"
+	"crypto/sha256"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/signing"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultMaxBodyBytes   = 64 << 10
+	DefaultIdempotencyTTL = 24 * time.Hour
+	DefaultRequestTimeout = 60 * time.Second
+
+	IdempotencyKeyHeader = "Idempotency-Key"
+	ReplayedHeader       = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLen = 256
+)
+
+var errKeyReused = errors.New("idempotency key was used with a different request body")
+
+type Server struct {
+	// Registrar 执行实际的注册，通常是 *deviceregister.Client
+	Registrar deviceregister.Registrar
+	// MaxBodyBytes 是请求体上限，为 0 时使用 DefaultMaxBodyBytes
+	MaxBodyBytes int64
+	// IdempotencyTTL 是成功结果的保留时间，为 0 时使用 DefaultIdempotencyTTL
+	IdempotencyTTL time.Duration
+	// RequestTimeout 是单次注册的超时，注册不跟随调用方的连接取消，
+	// 这样同一个 Idempotency-Key 的其他请求仍然能拿到结果
+	RequestTimeout time.Duration
+	// Ready 不为 nil 时 /readyz 会额外调用它
+	Ready func() error
+	// Verifier 不为 nil 时 POST /register 必须带有合法的签名，否则返回 401
+	Verifier *signing.Verifier
+
+	once     sync.Once
+	idem     *idempotency
+	draining int32
+	mux      *http.ServeMux
+}
+
+func New(r deviceregister.Registrar) *Server {
+	return &Server{Registrar: r}
+}
+
+func (s *Server) init() {
+	if s.MaxBodyBytes <= 0 {
+		s.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if s.IdempotencyTTL <= 0 {
+		s.IdempotencyTTL = DefaultIdempotencyTTL
+	}
+	if s.RequestTimeout <= 0 {
+		s.RequestTimeout = DefaultRequestTimeout
+	}
+
+	s.idem = newIdempotency(s.IdempotencyTTL)
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/register", s.handleRegister)
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/readyz", s.handleReadyz)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.once.Do(s.init)
+	s.mux.ServeHTTP(w, r)
+}
+
+// Drain 让 /readyz 返回 503，应在 http.Server.Shutdown 之前调用，给负载均衡摘流量的时间
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.draining) == 1 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	if s.Ready != nil {
+		if err := s.Ready(); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "error": err.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use POST")
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxBodyBytes))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", err.Error())
+		return
+	}
+
+	if s.Verifier != nil {
+		if err := s.Verifier.Verify(r, body, time.Now()); err != nil {
+			writeError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+			return
+		}
+	}
+
+	var dr deviceregister.DeviceRegister
+	if err := json.Unmarshal(body, &dr); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+	if err := dr.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, deviceregister.KindOf(err).String(), err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	if id := r.Header.Get("X-Trace-Id"); id != "" {
+		ctx = deviceregister.WithTraceID(ctx, id)
+	}
+
+	register := func() (*deviceregister.Response, error) {
+		rctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+		defer cancel()
+		if id := deviceregister.TraceID(ctx); id != "" {
+			rctx = deviceregister.WithTraceID(rctx, id)
+		}
+		return s.Registrar.Register(rctx, dr)
+	}
+
+	var (
+		res      *deviceregister.Response
+		replayed bool
+	)
+	key := r.Header.Get(IdempotencyKeyHeader)
+	switch {
+	case key == "":
+		res, err = register()
+	case len(key) > maxIdempotencyKeyLen:
+		writeError(w, http.StatusBadRequest, "invalid_idempotency_key", "Idempotency-Key is too long")
+		return
+	default:
+		res, replayed, err = s.idem.do(key, sha256.Sum256(body), register)
+	}
+
+	if replayed {
+		w.Header().Set(ReplayedHeader, "true")
+	}
+	if err == errKeyReused {
+		writeError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", err.Error())
+		return
+	}
+	if err != nil {
+		code := statusFor(err)
+		var ce *deviceregister.CircuitOpenError
+		if errors.As(err, &ce) && ce.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ce.RetryAfter.Seconds()))))
+		}
+		logs.CtxWarnKvs(ctx, "msg", "gateway register failed", "status", code, "kind", deviceregister.KindOf(err))
+		writeError(w, code, deviceregister.KindOf(err).String(), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// statusFor 把注册错误映射为网关的状态码
+func statusFor(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	switch deviceregister.KindOf(err) {
+	case deviceregister.KindInvalidRequest:
+		return http.StatusBadRequest
+	case deviceregister.KindCircuitOpen:
+		return http.StatusServiceUnavailable
+	case deviceregister.KindStatus:
+		var se *deviceregister.StatusError
+		if errors.As(err, &se) && se.StatusCode == http.StatusTooManyRequests {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusBadGateway
+	case deviceregister.KindTransport, deviceregister.KindMalformedResponse, deviceregister.KindEmptyIdentity:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, kind, msg string) {
+	writeJSON(w, code, map[string]string{"kind": kind, "error": msg})
+}
@@ -0,0 +1,262 @@
+package gateway
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testBody = `{"user_unique_id":"276095447832965","app_id":10000012,"os":"ios"}`
+
+// fakeRegistrar 按顺序返回 errs 中的错误，用完后注册成功；release 不为 nil 时等它关闭后才返回
+type fakeRegistrar struct {
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+	errs    []error
+}
+
+func (f *fakeRegistrar) Register(ctx context.Context, dr deviceregister.DeviceRegister) (*deviceregister.Response, error) {
+	n := atomic.AddInt32(&f.calls, 1)
+	if f.started != nil {
+		f.started <- struct{}{}
+	}
+	if f.release != nil {
+		<-f.release
+	}
+	if int(n) <= len(f.errs) {
+		return nil, f.errs[n-1]
+	}
+	return &deviceregister.Response{DeviceId: uint64(n), BdDid: dr.UserUniqueId}, nil
+}
+
+func post(h http.Handler, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/register", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyConcurrent(t *testing.T) {
+	r := &fakeRegistrar{started: make(chan struct{}, 1), release: make(chan struct{})}
+	s := New(r)
+
+	const n = 5
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = post(s, "k1", testBody)
+		}(i)
+	}
+	<-r.started
+	// 给其他请求时间进入等待，晚到的请求直接复用保存的结果
+	time.Sleep(50 * time.Millisecond)
+	close(r.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&r.calls); calls != 1 {
+		t.Fatalf("Register called %d times, want 1", calls)
+	}
+	replayed := 0
+	for i, w := range responses {
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"device_id":1`) {
+			t.Errorf("response %d = %d %s, want the single registration", i, w.Code, w.Body)
+		}
+		if w.Header().Get(ReplayedHeader) == "true" {
+			replayed++
+		}
+	}
+	if replayed != n-1 {
+		t.Errorf("%d responses replayed, want %d", replayed, n-1)
+	}
+}
+
+func TestIdempotencyKeyReused(t *testing.T) {
+	r := &fakeRegistrar{}
+	s := New(r)
+
+	if w := post(s, "k1", testBody); w.Code != http.StatusOK {
+		t.Fatalf("first request = %d %s", w.Code, w.Body)
+	}
+	other := strings.Replace(testBody, "276095447832965", "1", 1)
+	w := post(s, "k1", other)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key = %d %s, want 422", w.Code, w.Body)
+	}
+	if w := post(s, "k2", other); w.Code != http.StatusOK || w.Header().Get(ReplayedHeader) != "" {
+		t.Errorf("new key = %d %v, want a fresh registration", w.Code, w.Header())
+	}
+	if calls := atomic.LoadInt32(&r.calls); calls != 2 {
+		t.Errorf("Register called %d times, want 2", calls)
+	}
+}
+
+func TestIdempotencyFailureNotCached(t *testing.T) {
+	r := &fakeRegistrar{errs: []error{&deviceregister.StatusError{StatusCode: http.StatusServiceUnavailable}}}
+	s := New(r)
+
+	if w := post(s, "k1", testBody); w.Code != http.StatusBadGateway {
+		t.Fatalf("failed request = %d %s, want 502", w.Code, w.Body)
+	}
+	w := post(s, "k1", testBody)
+	if w.Code != http.StatusOK || w.Header().Get(ReplayedHeader) != "" {
+		t.Errorf("retry = %d %v, want a fresh registration", w.Code, w.Header())
+	}
+	if calls := atomic.LoadInt32(&r.calls); calls != 2 {
+		t.Errorf("Register called %d times, want 2", calls)
+	}
+}
+
+func TestIdempotencyExpires(t *testing.T) {
+	r := &fakeRegistrar{}
+	s := &Server{Registrar: r, IdempotencyTTL: 10 * time.Millisecond}
+
+	post(s, "k1", testBody)
+	time.Sleep(20 * time.Millisecond)
+	if w := post(s, "k1", testBody); w.Header().Get(ReplayedHeader) != "" {
+		t.Error("expired result was replayed")
+	}
+	if calls := atomic.LoadInt32(&r.calls); calls != 2 {
+		t.Errorf("Register called %d times, want 2", calls)
+	}
+}
+
+func TestRegisterRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		key    string
+		body   string
+		code   int
+		kind   string
+	}{
+		{"get", "GET", "", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"too large", "POST", "", `{"user_unique_id":"` + strings.Repeat("1", 100) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large"},
+		{"invalid json", "POST", "", `{"user_unique_id":`, http.StatusBadRequest, "invalid_json"},
+		{"invalid request", "POST", "", `{"user_unique_id":"1","app_id":10000012,"os":"symbian"}`, http.StatusBadRequest, deviceregister.KindInvalidRequest.String()},
+		{"key too long", "POST", strings.Repeat("k", maxIdempotencyKeyLen+1), testBody, http.StatusBadRequest, "invalid_idempotency_key"},
+	}
+	r := &fakeRegistrar{}
+	s := &Server{Registrar: r, MaxBodyBytes: 100}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/register", strings.NewReader(tt.body))
+			if tt.key != "" {
+				req.Header.Set(IdempotencyKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+
+			var res struct{ Kind string }
+			json.Unmarshal(w.Body.Bytes(), &res)
+			if w.Code != tt.code || res.Kind != tt.kind {
+				t.Errorf("response = %d %s, want %d %s", w.Code, w.Body, tt.code, tt.kind)
+			}
+		})
+	}
+	if calls := atomic.LoadInt32(&r.calls); calls != 0 {
+		t.Errorf("Register called %d times, want 0", calls)
+	}
+}
+
+func TestCircuitOpenRetryAfter(t *testing.T) {
+	s := New(&fakeRegistrar{errs: []error{&deviceregister.CircuitOpenError{RetryAfter: 1500 * time.Millisecond}}})
+	w := post(s, "", testBody)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("response = %d Retry-After %q, want 503 and 2", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	var ready error
+	s := New(&fakeRegistrar{})
+	s.Ready = func() error { return ready }
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	steps := []struct {
+		name    string
+		ready   error
+		drain   bool
+		readyz  int
+		healthz int
+	}{
+		{"ready", nil, false, http.StatusOK, http.StatusOK},
+		{"not ready", errors.New("cache not loaded"), false, http.StatusServiceUnavailable, http.StatusOK},
+		{"draining", nil, true, http.StatusServiceUnavailable, http.StatusOK},
+	}
+	for _, step := range steps {
+		ready = step.ready
+		if step.drain {
+			s.Drain()
+		}
+		if code := get("/readyz"); code != step.readyz {
+			t.Errorf("%s: /readyz = %d, want %d", step.name, code, step.readyz)
+		}
+		if code := get("/healthz"); code != step.healthz {
+			t.Errorf("%s: /healthz = %d, want %d", step.name, code, step.healthz)
+		}
+	}
+}
+
+func TestStatusFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{&deviceregister.TransportError{Err: context.DeadlineExceeded}, http.StatusGatewayTimeout},
+		{&deviceregister.ValidationError{Field: "os", Reason: "is empty"}, http.StatusBadRequest},
+		{&deviceregister.CircuitOpenError{}, http.StatusServiceUnavailable},
+		{&deviceregister.StatusError{StatusCode: http.StatusTooManyRequests}, http.StatusTooManyRequests},
+		{&deviceregister.StatusError{StatusCode: http.StatusInternalServerError}, http.StatusBadGateway},
+		{&deviceregister.StatusError{StatusCode: http.StatusForbidden}, http.StatusBadGateway},
+		{&deviceregister.TransportError{Err: errors.New("connection refused")}, http.StatusBadGateway},
+		{&deviceregister.DecodeError{Err: errors.New("eof")}, http.StatusBadGateway},
+		{deviceregister.ErrEmptyIdentity, http.StatusBadGateway},
+		{errors.New("unexpected"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := statusFor(tt.err); got != tt.want {
+			t.Errorf("statusFor(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestTraceIDPassedToRegistrar(t *testing.T) {
+	var got string
+	s := New(registrarFunc(func(ctx context.Context, dr deviceregister.DeviceRegister) (*deviceregister.Response, error) {
+		got = deviceregister.TraceID(ctx)
+		return &deviceregister.Response{DeviceId: 1}, nil
+	}))
+
+	req := httptest.NewRequest("POST", "/register", strings.NewReader(testBody))
+	req.Header.Set("X-Trace-Id", "trace-1")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "trace-1" {
+		t.Errorf("trace id = %q, want trace-1", got)
+	}
+}
+
+type registrarFunc func(ctx context.Context, dr deviceregister.DeviceRegister) (*deviceregister.Response, error)
+
+func (f registrarFunc) Register(ctx context.Context, dr deviceregister.DeviceRegister) (*deviceregister.Response, error) {
+	return f(ctx, dr)
+}
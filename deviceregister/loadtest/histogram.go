@@ -0,0 +1,104 @@
+package loadtest
+
+import (
+	"math"
+	"time"
+)
+
+// 桶的上界按 2^(1/8) 递增，相对误差约 9%，从 50µs 覆盖到约 2 分钟
+const (
+	histogramMin     = 50 * time.Microsecond
+	histogramFactor  = 1.0905077326652577 // 2^(1/8)
+	histogramBuckets = 170
+)
+
+// Histogram 是按指数分桶的延迟直方图，内存占用固定，不是并发安全的
+type Histogram struct {
+	counts []int64
+	count  int64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// Bucket 是直方图中的一个桶，Upper 为 0 表示超出最大上界
+type Bucket struct {
+	Upper time.Duration
+	Count int64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]int64, histogramBuckets+1)}
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	h.counts[bucketOf(d)]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *Histogram) Count() int64       { return h.count }
+func (h *Histogram) Max() time.Duration { return h.max }
+
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Quantile 返回 q 分位所在桶的上界，不超过最大值；q 取值 (0, 1]
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			if upper := bucketUpper(i); upper != 0 && upper < h.max {
+				return upper
+			}
+			return h.max
+		}
+	}
+
+	return h.max
+}
+
+// Buckets 返回所有非空的桶，按上界升序
+func (h *Histogram) Buckets() []Bucket {
+	var out []Bucket
+	for i, n := range h.counts {
+		if n > 0 {
+			out = append(out, Bucket{Upper: bucketUpper(i), Count: n})
+		}
+	}
+	return out
+}
+
+func bucketOf(d time.Duration) int {
+	if d <= histogramMin {
+		return 0
+	}
+
+	i := int(math.Ceil(math.Log(float64(d)/float64(histogramMin)) / math.Log(histogramFactor)))
+	if i > histogramBuckets {
+		return histogramBuckets
+	}
+	return i
+}
+
+func bucketUpper(i int) time.Duration {
+	if i >= histogramBuckets {
+		return 0
+	}
+	return time.Duration(float64(histogramMin) * math.Pow(histogramFactor, float64(i)))
+}
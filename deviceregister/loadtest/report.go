@@ -0,0 +1,175 @@
+package loadtest
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Report 是一次压测的结果，JSON 中的时间单位为毫秒，方便不同批次对比
+type Report struct {
+	Start    time.Time     `json:"start"`
+	Elapsed  time.Duration `json:"-"`
+	Rate     Rate          `json:"-"`
+	Requests int64         `json:"requests"`
+	// Succeeded 和 Failed 只统计发出的请求，Dropped 是到点时并发已满没有发出的请求
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+	// Errors 按错误类别统计失败数，status 错误会带上状态码，如 status_503
+	Errors map[string]int64 `json:"errors"`
+
+	Latency *Histogram `json:"-"`
+}
+
+type latencyJSON struct {
+	Mean      float64      `json:"mean_ms"`
+	P50       float64      `json:"p50_ms"`
+	P90       float64      `json:"p90_ms"`
+	P99       float64      `json:"p99_ms"`
+	Max       float64      `json:"max_ms"`
+	Histogram []bucketJSON `json:"histogram"`
+}
+
+type bucketJSON struct {
+	// Upper 为 0 表示超出最大的桶
+	Upper float64 `json:"le_ms"`
+	Count int64   `json:"count"`
+}
+
+// AchievedQPS 是实际发出请求的平均速率
+func (r *Report) AchievedQPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+func (r *Report) MarshalJSON() ([]byte, error) {
+	type plain Report
+	latency := latencyJSON{
+		Mean: ms(r.Latency.Mean()),
+		P50:  ms(r.Latency.Quantile(0.5)),
+		P90:  ms(r.Latency.Quantile(0.9)),
+		P99:  ms(r.Latency.Quantile(0.99)),
+		Max:  ms(r.Latency.Max()),
+	}
+	for _, b := range r.Latency.Buckets() {
+		latency.Histogram = append(latency.Histogram, bucketJSON{Upper: ms(b.Upper), Count: b.Count})
+	}
+
+	return json.Marshal(struct {
+		*plain
+		Elapsed     float64     `json:"elapsed_ms"`
+		StartQPS    float64     `json:"start_qps"`
+		TargetQPS   float64     `json:"target_qps"`
+		RampUp      float64     `json:"ramp_up_ms"`
+		AchievedQPS float64     `json:"achieved_qps"`
+		Latency     latencyJSON `json:"latency"`
+	}{
+		plain:       (*plain)(r),
+		Elapsed:     ms(r.Elapsed),
+		StartQPS:    r.Rate.Start,
+		TargetQPS:   r.Rate.Target,
+		RampUp:      ms(r.Rate.RampUp),
+		AchievedQPS: r.AchievedQPS(),
+		Latency:     latency,
+	})
+}
+
+// Print 以人类可读的格式输出报告
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "requests %d, succeeded %d, failed %d, dropped %d, elapsed %v\n",
+		r.Requests, r.Succeeded, r.Failed, r.Dropped, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "target qps %g, achieved qps %.1f\n", r.Rate.Target, r.AchievedQPS())
+
+	kinds := make([]string, 0, len(r.Errors))
+	for kind := range r.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %s: %d\n", kind, r.Errors[kind])
+	}
+
+	h := r.Latency
+	fmt.Fprintf(w, "latency p50 %v, p90 %v, p99 %v, max %v\n",
+		h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99), h.Max())
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// recorder 汇总并发返回的结果
+type recorder struct {
+	rate Rate
+
+	mu        sync.Mutex
+	latency   *Histogram
+	succeeded int64
+	failed    int64
+	dropped   int64
+	errors    map[string]int64
+}
+
+func newRecorder(rate Rate) *recorder {
+	return &recorder{rate: rate, latency: NewHistogram(), errors: make(map[string]int64)}
+}
+
+// record 忽略因为压测被中断而取消的请求
+func (rec *recorder) record(latency time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.latency.Record(latency)
+	if err != nil {
+		rec.failed++
+		rec.errors[errorKind(err)]++
+	} else {
+		rec.succeeded++
+	}
+}
+
+func (rec *recorder) drop() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.dropped++
+}
+
+func (rec *recorder) report(start time.Time, elapsed time.Duration) *Report {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return &Report{
+		Start:     start,
+		Elapsed:   elapsed,
+		Rate:      rec.rate,
+		Requests:  rec.succeeded + rec.failed,
+		Succeeded: rec.succeeded,
+		Failed:    rec.failed,
+		Dropped:   rec.dropped,
+		Errors:    rec.errors,
+		Latency:   rec.latency,
+	}
+}
+
+func errorKind(err error) string {
+	var se *deviceregister.StatusError
+	if errors.As(err, &se) {
+		return "status_" + strconv.Itoa(se.StatusCode)
+	}
+	return deviceregister.KindOf(err).String()
+}
@@ -0,0 +1,166 @@
+// Package loadtest 按目标速率持续调用 device_register，统计延迟分布和错误，
+// 用于私有化部署上线前验证注册服务能否承受预期的 QPS。
+package loadtest
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate 是请求速率的变化：在 RampUp 内从 Start 线性增加到 Target，之后保持 Target 直到 Duration 结束。
+// RampUp 为 0 时全程使用 Target。
+type Rate struct {
+	Start    float64
+	Target   float64
+	RampUp   time.Duration
+	Duration time.Duration
+}
+
+func (r Rate) validate() error {
+	if r.Target <= 0 || r.Start < 0 {
+		return fmt.Errorf("loadtest: rate must be positive, got start %v target %v", r.Start, r.Target)
+	}
+	if r.Duration <= 0 || r.RampUp < 0 || r.RampUp > r.Duration {
+		return fmt.Errorf("loadtest: invalid duration %v with ramp up %v", r.Duration, r.RampUp)
+	}
+
+	return nil
+}
+
+// offset 返回第 n 个请求（从 0 开始）相对开始时间的发出时刻。
+// 爬坡阶段累计请求数为 N(t) = Start*t + (Target-Start)*t²/(2*RampUp)，对其求逆。
+func (r Rate) offset(n int64) time.Duration {
+	ramp := r.RampUp.Seconds()
+	// 爬坡阶段一共发出的请求数
+	rampRequests := (r.Start + r.Target) / 2 * ramp
+
+	var t float64
+	switch x := float64(n); {
+	case x == 0:
+		// Start 为 0 时下面的分母也是 0
+		t = 0
+	case x < rampRequests:
+		a, b := (r.Target-r.Start)/(2*ramp), r.Start
+		// 等价于 (-b + sqrt(b²+4ax)) / 2a，在 a 为 0 时也成立
+		t = 2 * x / (b + math.Sqrt(b*b+4*a*x))
+	default:
+		t = ramp + (x-rampRequests)/r.Target
+	}
+
+	return time.Duration(t * float64(time.Second))
+}
+
+// Users 生成互不重复的用户，user_unique_id 为 Prefix 加递增序号，os 在 Oses 中轮流取
+type Users struct {
+	AppId  uint32
+	Oses   []string
+	Prefix string
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+func (u *Users) next() deviceregister.DeviceRegister {
+	u.mu.Lock()
+	u.seq++
+	seq := u.seq
+	u.mu.Unlock()
+
+	os := "android"
+	if len(u.Oses) > 0 {
+		os = u.Oses[int(seq-1)%len(u.Oses)]
+	}
+
+	return deviceregister.DeviceRegister{
+		UserUniqueId: u.Prefix + strconv.FormatUint(seq, 10),
+		AppId:        u.AppId,
+		Os:           os,
+	}
+}
+
+// Runner 以开环方式发起请求：按 Rate 的时间点发出，不等待前一个请求返回。
+// 进行中的请求达到 MaxInFlight 时，到点的请求不再发出，计入 Dropped，
+// 这说明服务端跟不上目标速率，而不是让压测工具自己降速。
+type Runner struct {
+	Registrar deviceregister.Registrar
+	Rate      Rate
+	Users     *Users
+	// MaxInFlight 小于 1 时为 1000
+	MaxInFlight int
+}
+
+// Run 持续到 Rate.Duration 结束或 ctx 取消，等待进行中的请求返回后输出报告
+func (rn *Runner) Run(ctx context.Context) (*Report, error) {
+	if rn.Registrar == nil || rn.Users == nil {
+		return nil, errors.New("loadtest: registrar and users are required")
+	}
+	if err := rn.Rate.validate(); err != nil {
+		return nil, err
+	}
+	maxInFlight := rn.MaxInFlight
+	if maxInFlight < 1 {
+		maxInFlight = 1000
+	}
+
+	rec := newRecorder(rn.Rate)
+	slots := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for n := int64(0); ; n++ {
+		at := rn.Rate.offset(n)
+		if at >= rn.Rate.Duration {
+			break
+		}
+		// 落后于计划时 sleepUntil 立即返回，追上计划的速率
+		if err := sleepUntil(ctx, start.Add(at)); err != nil {
+			break
+		}
+
+		select {
+		case slots <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				rec.record(rn.register(ctx))
+			}()
+		default:
+			rec.drop()
+		}
+	}
+	wg.Wait()
+
+	return rec.report(start, time.Since(start)), nil
+}
+
+func (rn *Runner) register(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	_, err := rn.Registrar.Register(ctx, rn.Users.next())
+	return time.Since(start), err
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
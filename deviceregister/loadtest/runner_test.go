@@ -0,0 +1,32 @@
+package loadtest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateOffset(t *testing.T) {
+	tests := []struct {
+		name string
+		rate Rate
+		n    int64
+		want time.Duration
+	}{
+		{"constant first", Rate{Target: 10, Duration: time.Minute}, 0, 0},
+		{"constant", Rate{Target: 10, Duration: time.Minute}, 5, 500 * time.Millisecond},
+		{"ramp from zero first", Rate{Target: 10, RampUp: 10 * time.Second, Duration: time.Minute}, 0, 0},
+		// N(t) = t²/2，N = 2 时 t = 2s
+		{"ramp from zero", Rate{Target: 10, RampUp: 10 * time.Second, Duration: time.Minute}, 2, 2 * time.Second},
+		// 爬坡阶段共 50 个请求，之后每秒 10 个
+		{"after ramp", Rate{Target: 10, RampUp: 10 * time.Second, Duration: time.Minute}, 60, 11 * time.Second},
+		{"ramp from start", Rate{Start: 10, Target: 10, RampUp: 10 * time.Second, Duration: time.Minute}, 5, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rate.offset(tt.n)
+			if d := got - tt.want; d < -time.Microsecond || d > time.Microsecond {
+				t.Errorf("offset(%d) = %v, want %v", tt.n, got, tt.want)
+			}
+		})
+	}
+}
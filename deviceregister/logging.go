@@ -0,0 +1,147 @@
+package deviceregister
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"strings"
+)
+
+// Redaction 决定日志中 user_unique_id、设备标识等字段的输出方式
+type Redaction int
+
+const (
+	// RedactHash 输出加盐 SHA-256 的前 12 位，同一个值在日志中可以关联但不可还原
+	RedactHash Redaction = iota
+	// RedactMask 只保留首尾各两个字符
+	RedactMask
+	// RedactNone 原样输出，只应在排查问题时使用
+	RedactNone
+)
+
+func (r Redaction) String() string {
+	switch r {
+	case RedactHash:
+		return "hash"
+	case RedactMask:
+		return "mask"
+	case RedactNone:
+		return "none"
+	default:
+		return fmt.Sprintf("Redaction(%d)", int(r))
+	}
+}
+
+func ParseRedaction(s string) (Redaction, error) {
+	switch strings.ToLower(s) {
+	case "hash", "":
+		return RedactHash, nil
+	case "mask":
+		return RedactMask, nil
+	case "none":
+		return RedactNone, nil
+	default:
+		return 0, fmt.Errorf("deviceregister: unknown redaction %q, expect hash, mask or none", s)
+	}
+}
+
+// WithRedaction 设置日志脱敏方式，默认 RedactHash。salt 只对 RedactHash 生效
+func WithRedaction(r Redaction, salt string) Option {
+	return func(c *Client) {
+		c.redaction = r
+		c.redactionSalt = salt
+	}
+}
+
+// WithDebugPayloads 在 Info 级别输出完整的请求体和响应体，不做脱敏，排查问题时不需要调低日志级别
+func WithDebugPayloads(debug bool) Option {
+	return func(c *Client) {
+		c.debugPayloads = debug
+	}
+}
+
+type traceIdKey struct{}
+type debugKey struct{}
+
+// logIdKey 是 logs 读取 LogID 的 context key
+const logIdKey = "K_LOGID"
+
+// WithTraceID 给 ctx 设置 trace id，日志的 LogID 和 trace_id 字段都会使用它。
+// Register 发现 ctx 中没有 trace id 时会自动生成一个。
+func WithTraceID(ctx context.Context, traceId string) context.Context {
+	ctx = context.WithValue(ctx, traceIdKey{}, traceId)
+	ctx = context.WithValue(ctx, logIdKey, traceId)
+	return ctx
+}
+
+// TraceID 返回 ctx 中的 trace id，没有时返回空字符串
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIdKey{}).(string)
+	return id
+}
+
+// DebugContext 只对这次调用输出完整的请求体和响应体，效果同 WithDebugPayloads
+func DebugContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, debugKey{}, true)
+}
+
+func ensureTraceID(ctx context.Context) context.Context {
+	if TraceID(ctx) != "" {
+		return ctx
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return ctx
+	}
+	return WithTraceID(ctx, strings.Replace(id, "-", "", -1))
+}
+
+func (c *Client) debug(ctx context.Context) bool {
+	if c.debugPayloads {
+		return true
+	}
+	v, _ := ctx.Value(debugKey{}).(bool)
+	return v
+}
+
+// redact 按 Client 的策略处理一个敏感值
+func (c *Client) redact(v string) string {
+	if v == "" {
+		return v
+	}
+
+	switch c.redaction {
+	case RedactNone:
+		return v
+	case RedactMask:
+		if len(v) <= 4 {
+			return strings.Repeat("*", len(v))
+		}
+		return v[:2] + strings.Repeat("*", len(v)-4) + v[len(v)-2:]
+	default:
+		sum := sha256.Sum256([]byte(c.redactionSalt + v))
+		return "h:" + hex.EncodeToString(sum[:6])
+	}
+}
+
+// logError 返回适合写日志的错误描述，非 debug 时不包含响应体
+func (c *Client) logError(ctx context.Context, err error) string {
+	if c.debug(ctx) {
+		return err.Error()
+	}
+
+	var se *StatusError
+	if errors.As(err, &se) {
+		return fmt.Sprintf("%v %d", ErrStatus, se.StatusCode)
+	}
+	var de *DecodeError
+	if errors.As(err, &de) {
+		return fmt.Sprintf("%v: %v", ErrMalformedResponse, de.Err)
+	}
+
+	return err.Error()
+}
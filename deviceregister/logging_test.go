@@ -0,0 +1,126 @@
+package deviceregister
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		redaction Redaction
+		salt      string
+		in        string
+		want      string
+	}{
+		{RedactNone, "", "276095447832965", "276095447832965"},
+		{RedactMask, "", "276095447832965", "27***********65"},
+		{RedactMask, "", "abcde", "ab*de"},
+		{RedactMask, "", "abcd", "****"},
+		{RedactMask, "", "", ""},
+		{RedactHash, "", "", ""},
+	}
+	for _, tt := range tests {
+		c := &Client{redaction: tt.redaction, redactionSalt: tt.salt}
+		if got := c.redact(tt.in); got != tt.want {
+			t.Errorf("%v redact(%q) = %q, want %q", tt.redaction, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactHash(t *testing.T) {
+	hashed := regexp.MustCompile(`^h:[0-9a-f]{12}$`)
+	a := &Client{redaction: RedactHash, redactionSalt: "a"}
+	b := &Client{redaction: RedactHash, redactionSalt: "b"}
+
+	v := a.redact("276095447832965")
+	if !hashed.MatchString(v) || strings.Contains(v, "276095447832965") {
+		t.Fatalf("redact = %q, want h: and 12 hex digits", v)
+	}
+	// 同一个盐的结果可以关联，不同的盐不能
+	if again := a.redact("276095447832965"); again != v {
+		t.Errorf("redact is not stable: %q and %q", v, again)
+	}
+	if other := b.redact("276095447832965"); other == v {
+		t.Errorf("redact with another salt = %q, want a different hash", other)
+	}
+	if other := a.redact("276095447832966"); other == v {
+		t.Errorf("redact of another value = %q, want a different hash", other)
+	}
+}
+
+func TestParseRedaction(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Redaction
+		ok   bool
+	}{
+		{"", RedactHash, true},
+		{"hash", RedactHash, true},
+		{"MASK", RedactMask, true},
+		{"none", RedactNone, true},
+		{"blur", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRedaction(tt.s)
+		if (err == nil) != tt.ok || tt.ok && got != tt.want {
+			t.Errorf("ParseRedaction(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestEnsureTraceID(t *testing.T) {
+	ctx := ensureTraceID(WithTraceID(context.Background(), "trace-1"))
+	if id := TraceID(ctx); id != "trace-1" {
+		t.Errorf("TraceID = %q, want the existing trace-1", id)
+	}
+
+	ctx = ensureTraceID(context.Background())
+	id := TraceID(ctx)
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(id) {
+		t.Fatalf("generated trace id = %q, want 32 hex digits", id)
+	}
+	if logId, _ := ctx.Value(logIdKey).(string); logId != id {
+		t.Errorf("LogID = %q, want the trace id %q", logId, id)
+	}
+	if other := TraceID(ensureTraceID(context.Background())); other == id {
+		t.Errorf("two generated trace ids are both %q", id)
+	}
+}
+
+// roundTripFunc 用函数实现 http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestRegisterPropagatesTraceID(t *testing.T) {
+	var seen []string
+	hc := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		seen = append(seen, TraceID(r.Context()))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"device_id":1,"install_id":2,"bd_did":"b","new_user":1}`)),
+			Request:    r,
+		}, nil
+	})}
+	c, err := NewClient(WithHTTPClient(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dr := DeviceRegister{UserUniqueId: "276095447832965", AppId: 10000012, Os: "ios"}
+	if _, err := c.Register(WithTraceID(context.Background(), "trace-1"), dr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Register(context.Background(), dr); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[0] != "trace-1" || seen[1] == "" || seen[1] == "trace-1" {
+		t.Errorf("trace ids seen by the transport = %q, want trace-1 then a generated one", seen)
+	}
+}
@@ -0,0 +1,166 @@
+package deviceregister
+
+import (
+	"code.byted.org/gopkg/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 打点名称，tag 都包含 app_id 和 os，失败还带 kind。
+// MetricBreakerState 是熔断器的状态变化，tag 只有 from 和 to；MetricEjection 的 tag 只有 endpoint
+const (
+	MetricAttempt         = "device_register.attempt"
+	MetricSuccess         = "device_register.success"
+	MetricFailure         = "device_register.failure"
+	MetricRetry           = "device_register.retry"
+	MetricCacheHit        = "device_register.cache_hit"
+	MetricBreakerRejected = "device_register.breaker_rejected"
+	MetricBreakerState    = "device_register.breaker_state"
+	MetricFailover        = "device_register.failover"
+	MetricEjection        = "device_register.ejection"
+	MetricQueued          = "device_register.queued"
+	MetricLatency         = "device_register.latency"
+	MetricAttemptLatency  = "device_register.attempt_latency"
+)
+
+// MetricsSink 接收 Client 的打点，实现必须可以并发使用
+type MetricsSink interface {
+	Counter(name string, value int64, tags map[string]string)
+	Timer(name string, d time.Duration, tags map[string]string)
+}
+
+// WithMetrics 设置打点，默认不打点
+func WithMetrics(sink MetricsSink) Option {
+	return func(c *Client) {
+		c.metrics = sink
+	}
+}
+
+type nopSink struct{}
+
+func (nopSink) Counter(string, int64, map[string]string)       {}
+func (nopSink) Timer(string, time.Duration, map[string]string) {}
+
+// metricsClientSink 把打点发给 metrics agent
+type metricsClientSink struct {
+	cli *metrics.MetricsClientV2
+}
+
+// NewMetricsClientSink 使用 metrics.MetricsClientV2 打点，Timer 的单位与 metrics.Timer 一致为纳秒
+func NewMetricsClientSink(cli *metrics.MetricsClientV2) MetricsSink {
+	return &metricsClientSink{cli: cli}
+}
+
+func (s *metricsClientSink) Counter(name string, value int64, tags map[string]string) {
+	s.cli.EmitCounter(name, value, metrics.Map2Tags(tags)...)
+}
+
+func (s *metricsClientSink) Timer(name string, d time.Duration, tags map[string]string) {
+	s.cli.EmitTimer(name, d.Nanoseconds(), metrics.Map2Tags(tags)...)
+}
+
+// MemorySink 把打点保存在内存中，用于测试和调试
+type MemorySink struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	timers   map[string][]time.Duration
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{
+		counters: make(map[string]int64),
+		timers:   make(map[string][]time.Duration),
+	}
+}
+
+func (s *MemorySink) Counter(name string, value int64, tags map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters[seriesKey(name, tags)] += value
+}
+
+func (s *MemorySink) Timer(name string, d time.Duration, tags map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := seriesKey(name, tags)
+	s.timers[key] = append(s.timers[key], d)
+}
+
+// CounterValue 返回 name 和 tags 完全匹配的计数之和
+func (s *MemorySink) CounterValue(name string, tags map[string]string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.counters[seriesKey(name, tags)]
+}
+
+// TimerValues 返回 name 和 tags 完全匹配的所有耗时
+func (s *MemorySink) TimerValues(name string, tags map[string]string) []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]time.Duration(nil), s.timers[seriesKey(name, tags)]...)
+}
+
+// Series 返回所有打过点的序列，形如 name{k1=v1,k2=v2}
+func (s *MemorySink) Series() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.counters)+len(s.timers))
+	for k := range s.counters {
+		keys = append(keys, k)
+	}
+	for k := range s.timers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (s *MemorySink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counters = make(map[string]int64)
+	s.timers = make(map[string][]time.Duration)
+}
+
+func seriesKey(name string, tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricTags 在平台未知时 os 为 unknown，避免不合法的输入产生大量序列
+func metricTags(dr DeviceRegister, p Platform) map[string]string {
+	os := p.Name
+	if os == "" {
+		os = "unknown"
+	}
+
+	return map[string]string{
+		"app_id": strconv.FormatUint(uint64(dr.AppId), 10),
+		"os":     os,
+	}
+}
+
+func withTag(tags map[string]string, k, v string) map[string]string {
+	out := make(map[string]string, len(tags)+1)
+	for tk, tv := range tags {
+		out[tk] = tv
+	}
+	out[k] = v
+
+	return out
+}
@@ -0,0 +1,95 @@
+package deviceregister_test
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	tags := map[string]string{"app_id": "10000012", "os": "ios"}
+	withKind := func(kind string) map[string]string {
+		return map[string]string{"app_id": "10000012", "os": "ios", "kind": kind}
+	}
+
+	type counter struct {
+		name  string
+		tags  map[string]string
+		value int64
+	}
+	tests := []struct {
+		name     string
+		faults   []mockserver.Fault
+		os       string
+		counters []counter
+		attempts int
+	}{
+		{
+			name: "success",
+			counters: []counter{
+				{deviceregister.MetricAttempt, tags, 1},
+				{deviceregister.MetricSuccess, tags, 1},
+				{deviceregister.MetricFailure, withKind("status"), 0},
+			},
+			attempts: 1,
+		},
+		{
+			name:   "retry then success",
+			faults: []mockserver.Fault{{Status: http.StatusServiceUnavailable}},
+			counters: []counter{
+				{deviceregister.MetricAttempt, tags, 2},
+				{deviceregister.MetricRetry, withKind("status"), 1},
+				{deviceregister.MetricSuccess, tags, 1},
+			},
+			attempts: 2,
+		},
+		{
+			name:   "failure",
+			faults: []mockserver.Fault{{Status: http.StatusBadRequest}},
+			counters: []counter{
+				{deviceregister.MetricAttempt, tags, 1},
+				{deviceregister.MetricRetry, withKind("status"), 0},
+				{deviceregister.MetricFailure, withKind("status"), 1},
+				{deviceregister.MetricSuccess, tags, 0},
+			},
+			attempts: 1,
+		},
+		{
+			name: "unknown os",
+			os:   "symbian",
+			counters: []counter{
+				{deviceregister.MetricAttempt, map[string]string{"app_id": "10000012", "os": "unknown"}, 0},
+				{deviceregister.MetricFailure, map[string]string{"app_id": "10000012", "os": "unknown", "kind": "invalid_request"}, 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := mockserver.Start()
+			defer ts.Close()
+			s.Script(tt.faults...)
+
+			sink := deviceregister.NewMemorySink()
+			c := testClient(t, ts.URL,
+				deviceregister.WithMetrics(sink),
+				deviceregister.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+			dr := testDevice()
+			if tt.os != "" {
+				dr.Os = tt.os
+			}
+			c.Register(context.Background(), dr)
+
+			for _, want := range tt.counters {
+				if got := sink.CounterValue(want.name, want.tags); got != want.value {
+					t.Errorf("%s%v = %d, want %d; series %v", want.name, want.tags, got, want.value, sink.Series())
+				}
+			}
+			if got := len(sink.TimerValues(deviceregister.MetricAttemptLatency, tags)); got != tt.attempts {
+				t.Errorf("%s samples = %d, want %d", deviceregister.MetricAttemptLatency, got, tt.attempts)
+			}
+		})
+	}
+}
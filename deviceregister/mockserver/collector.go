@@ -0,0 +1,189 @@
+package mockserver
+
+import (
+	"do_some_fxxking_test/deviceregister/signing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AppLogPath 是事件上报接口的路径
+const AppLogPath = "/service/2/app_log/"
+
+// Collector 是 /service/2/app_log/ 的模拟实现，保存收到的每一批事件。
+// 请求体的 header 按注册请求的规则校验，故障注入方式与 Server 相同，只支持 latency、status 和 retry_after。
+type Collector struct {
+	// Verifier 不为 nil 时要求请求带有合法的签名，否则返回 401
+	Verifier *signing.Verifier
+
+	mu      sync.Mutex
+	batches []Batch
+	script  []Fault
+	count   int
+}
+
+// Batch 是一次上报请求
+type Batch struct {
+	Header map[string]interface{} `json:"header"`
+	Events []Event                `json:"events"`
+}
+
+// Event 是上报请求中的一个事件
+type Event struct {
+	Event       string                 `json:"event"`
+	Params      map[string]interface{} `json:"params"`
+	LocalTimeMs int64                  `json:"local_time_ms"`
+}
+
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// StartCollector 在随机端口启动一个进程内的 Collector，返回值的 URL 加上 AppLogPath 即为 endpoint
+func StartCollector() (*Collector, *httptest.Server) {
+	c := NewCollector()
+	return c, httptest.NewServer(c)
+}
+
+// Script 追加故障，之后的请求依次使用，用完后恢复正常
+func (c *Collector) Script(faults ...Fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.script = append(c.script, faults...)
+}
+
+// Requests 返回收到的上报请求数，包括注入故障的请求
+func (c *Collector) Requests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.count
+}
+
+// Batches 返回成功接收的批次，按接收顺序
+func (c *Collector) Batches() []Batch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Batch(nil), c.batches...)
+}
+
+// Events 返回成功接收的所有事件，按接收顺序
+func (c *Collector) Events() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var events []Event
+	for _, b := range c.batches {
+		events = append(events, b.Events...)
+	}
+	return events
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != AppLogPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	fault, err := c.fault(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault.Status != 0 {
+		if fault.RetryAfter != "" {
+			w.Header().Set("Retry-After", fault.RetryAfter)
+		}
+		writeError(w, fault.Status, "injected fault")
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "read body: "+err.Error())
+		return
+	}
+	if c.Verifier != nil {
+		if err := c.Verifier.Verify(r, body, time.Now()); err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		if body, err = gunzip(body); err != nil {
+			writeError(w, http.StatusBadRequest, "gunzip body: "+err.Error())
+			return
+		}
+	}
+
+	batch, err := parseBatch(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	c.batches = append(c.batches, batch)
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"e": 0, "sc": len(batch.Events)})
+}
+
+func (c *Collector) fault(r *http.Request) (Fault, error) {
+	c.mu.Lock()
+	c.count++
+	var scripted *Fault
+	if len(c.script) > 0 {
+		scripted = &c.script[0]
+		c.script = c.script[1:]
+	}
+	c.mu.Unlock()
+
+	return requestFault(r, scripted)
+}
+
+// parseBatch 校验 header 和 events，每个事件都必须有名字和时间
+func parseBatch(body []byte) (Batch, error) {
+	if _, err := parseHeader(body); err != nil {
+		return Batch{}, err
+	}
+
+	var b Batch
+	if err := json.Unmarshal(body, &b); err != nil {
+		return Batch{}, fmt.Errorf("invalid json: %v", err)
+	}
+	if len(b.Events) == 0 {
+		return Batch{}, errors.New("events is empty")
+	}
+	for i, e := range b.Events {
+		if e.Event == "" {
+			return Batch{}, fmt.Errorf("events[%d].event is missing", i)
+		}
+		if e.LocalTimeMs <= 0 {
+			return Batch{}, fmt.Errorf("events[%d].local_time_ms is missing", i)
+		}
+	}
+
+	return b, nil
+}
@@ -0,0 +1,93 @@
+package mockserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fault 描述一次请求要注入的故障，零值表示正常返回
+type Fault struct {
+	// Latency 是返回前的等待时间
+	Latency time.Duration
+	// Status 不为 0 时直接返回该状态码
+	Status int
+	// RetryAfter 不为空时设置 Retry-After 头
+	RetryAfter string
+	// Truncate 返回声明长度一半的响应体后断开连接
+	Truncate bool
+	// Malformed 返回不是 JSON 的响应体
+	Malformed bool
+	// Empty 返回 device_id、bd_did、cd 都为空的响应
+	Empty bool
+	// Bomb 返回一个很小的 gzip 响应体，解压后有 16MB
+	Bomb bool
+}
+
+// ParseFault 解析逗号分隔的故障描述，例如：
+//
+//	latency=200ms
+//	status=503
+//	429,retry_after=2
+//	truncate
+//	malformed
+//	empty
+//	bomb
+//
+// 单独的数字等价于 status=数字。
+func ParseFault(s string) (Fault, error) {
+	var f Fault
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		key, value := item, ""
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			key, value = item[:i], item[i+1:]
+		}
+
+		switch key {
+		case "latency":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Fault{}, fmt.Errorf("mockserver: invalid latency %q: %v", value, err)
+			}
+			f.Latency = d
+		case "status":
+			code, err := parseStatus(value)
+			if err != nil {
+				return Fault{}, err
+			}
+			f.Status = code
+		case "retry_after":
+			f.RetryAfter = value
+		case "truncate":
+			f.Truncate = true
+		case "malformed":
+			f.Malformed = true
+		case "empty":
+			f.Empty = true
+		case "bomb":
+			f.Bomb = true
+		default:
+			code, err := parseStatus(key)
+			if err != nil || value != "" {
+				return Fault{}, fmt.Errorf("mockserver: unknown fault %q", item)
+			}
+			f.Status = code
+		}
+	}
+
+	return f, nil
+}
+
+func parseStatus(s string) (int, error) {
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 100 || code > 599 {
+		return 0, fmt.Errorf("mockserver: invalid status %q", s)
+	}
+	return code, nil
+}
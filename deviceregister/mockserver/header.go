@@ -0,0 +1,56 @@
+package mockserver
+
+import (
+	"do_some_fxxking_test/deviceregister"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// header 是请求体中 header 字段里 mock 关心的部分
+type header struct {
+	Aid          uint32 `json:"aid"`
+	UserUniqueId string `json:"user_unique_id"`
+	Os           string `json:"os"`
+}
+
+// parseHeader 按 generateBody 生成的格式校验请求体，
+// os 必须是已注册平台的枚举值，且平台对应的标识字段不能为空
+func parseHeader(body []byte) (header, error) {
+	var envelope struct {
+		Header map[string]json.RawMessage `json:"header"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return header{}, fmt.Errorf("invalid json: %v", err)
+	}
+	if envelope.Header == nil {
+		return header{}, errors.New("header is missing")
+	}
+
+	raw, _ := json.Marshal(envelope.Header)
+	var h header
+	if err := json.Unmarshal(raw, &h); err != nil {
+		return header{}, fmt.Errorf("invalid header: %v", err)
+	}
+	if h.Aid == 0 {
+		return header{}, errors.New("header.aid is missing")
+	}
+	if h.UserUniqueId == "" {
+		return header{}, errors.New("header.user_unique_id is missing")
+	}
+
+	p, ok := deviceregister.LookupWireOs(h.Os)
+	if !ok {
+		return header{}, fmt.Errorf("header.os %q is not supported", h.Os)
+	}
+
+	var udid string
+	if v, ok := envelope.Header[p.IdentifierField]; ok {
+		json.Unmarshal(v, &udid)
+	}
+	if udid == "" {
+		return header{}, fmt.Errorf("header.%s is required for %s", p.IdentifierField, p.WireOs)
+	}
+
+	return h, nil
+}
@@ -0,0 +1,277 @@
+// Package mockserver 是 /service/2/device_register/ 和 /service/2/app_log/ 的本地模拟实现，
+// 用于没有私有化环境时的测试和演示。
+//
+// 同一个 (aid, os, user_unique_id) 总是得到相同的 device_id 和 install_id，
+// 故障可以通过 X-Mock-Fault 请求头、fault 查询参数或 Server.Script 按请求注入，格式见 ParseFault。
+package mockserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"do_some_fxxking_test/deviceregister/signing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Path        = "/service/2/device_register/"
+	FaultHeader = "X-Mock-Fault"
+
+	maxBodySize = 1 << 20
+)
+
+type Server struct {
+	// Verifier 不为 nil 时要求请求带有合法的签名，否则返回 401
+	Verifier *signing.Verifier
+
+	mu     sync.Mutex
+	seen   map[string]bool
+	script []Fault
+	count  int
+}
+
+func New() *Server {
+	return &Server{seen: make(map[string]bool)}
+}
+
+// Start 在随机端口启动一个进程内的 Server，返回值的 URL 加上 Path 即为 endpoint
+func Start() (*Server, *httptest.Server) {
+	s := New()
+	return s, httptest.NewServer(s)
+}
+
+// Script 追加故障，之后的请求依次使用，用完后恢复正常
+func (s *Server) Script(faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.script = append(s.script, faults...)
+}
+
+// Requests 返回收到的注册请求数
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.count
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != Path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	fault, err := s.fault(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault.Status != 0 {
+		if fault.RetryAfter != "" {
+			w.Header().Set("Retry-After", fault.RetryAfter)
+		}
+		writeError(w, fault.Status, "injected fault")
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "read body: "+err.Error())
+		return
+	}
+
+	if s.Verifier != nil {
+		if err := s.Verifier.Verify(r, body, time.Now()); err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		if body, err = gunzip(body); err != nil {
+			writeError(w, http.StatusBadRequest, "gunzip body: "+err.Error())
+			return
+		}
+	}
+
+	h, err := parseHeader(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if fault.Bomb {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(bomb())
+		return
+	}
+	if fault.Malformed {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"device_id": 1, "bd_did": `))
+		return
+	}
+
+	res := s.register(h)
+	if fault.Empty {
+		res = response{ServerTime: res.ServerTime}
+	}
+
+	data, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	if fault.Truncate {
+		// 声明完整长度但只写一半，客户端会读到 unexpected EOF
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:len(data)/2])
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write(data)
+		zw.Close()
+		return
+	}
+	w.Write(data)
+}
+
+// gunzip 解压请求体，解压后同样受 maxBodySize 限制
+func gunzip(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	out, err := ioutil.ReadAll(io.LimitReader(zr, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxBodySize {
+		return nil, errors.New("decompressed body too large")
+	}
+	return out, nil
+}
+
+var (
+	bombOnce sync.Once
+	bombBody []byte
+)
+
+func bomb() []byte {
+	bombOnce.Do(func() {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(bytes.Repeat([]byte(" "), 16<<20))
+		zw.Close()
+		bombBody = buf.Bytes()
+	})
+	return bombBody
+}
+
+// fault 依次从请求头、查询参数和 Script 中取本次请求的故障
+func (s *Server) fault(r *http.Request) (Fault, error) {
+	s.mu.Lock()
+	s.count++
+	var scripted *Fault
+	if len(s.script) > 0 {
+		scripted = &s.script[0]
+		s.script = s.script[1:]
+	}
+	s.mu.Unlock()
+
+	return requestFault(r, scripted)
+}
+
+// requestFault 优先使用请求头和查询参数中的故障，其次是 Script 中取出的 scripted
+func requestFault(r *http.Request, scripted *Fault) (Fault, error) {
+	if v := r.Header.Get(FaultHeader); v != "" {
+		return ParseFault(v)
+	}
+	if v := r.URL.Query().Get("fault"); v != "" {
+		return ParseFault(v)
+	}
+	if scripted != nil {
+		return *scripted, nil
+	}
+
+	return Fault{}, nil
+}
+
+// response 与 deviceregister.Response 的 JSON 字段一致
+type response struct {
+	DeviceId     uint64 `json:"device_id"`
+	InstallId    uint64 `json:"install_id"`
+	BdDid        string `json:"bd_did"`
+	Cd           string `json:"cd"`
+	InstallIdStr string `json:"install_id_str"`
+	NewUser      uint8  `json:"new_user"`
+	Ssid         string `json:"ssid"`
+	ServerTime   uint64 `json:"server_time"`
+}
+
+func (s *Server) register(h header) response {
+	key := fmt.Sprintf("%d/%s/%s", h.Aid, h.Os, h.UserUniqueId)
+
+	s.mu.Lock()
+	newUser := !s.seen[key]
+	s.seen[key] = true
+	s.mu.Unlock()
+
+	deviceId := stableId("device", key)
+	installId := stableId("install", key)
+
+	res := response{
+		DeviceId:     deviceId,
+		InstallId:    installId,
+		BdDid:        fmt.Sprintf("%016X", stableId("bd_did", key)),
+		Cd:           fmt.Sprintf("%x", stableId("cd", key)),
+		InstallIdStr: strconv.FormatUint(installId, 10),
+		Ssid:         fmt.Sprintf("%016x-%016x", stableId("ssid", key), stableId("ssid2", key)),
+		ServerTime:   uint64(time.Now().Unix()),
+	}
+	if newUser {
+		res.NewUser = 1
+	}
+
+	return res
+}
+
+// stableId 返回 63 位以内的正数，保证在 JSON 中不会被误当成负数
+func stableId(kind, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return h.Sum64()&(1<<62-1) | 1<<60
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": code, "message": msg})
+}
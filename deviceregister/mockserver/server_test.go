@@ -0,0 +1,111 @@
+package mockserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFault(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Fault
+		err  string
+	}{
+		{in: "", want: Fault{}},
+		{in: "latency=200ms", want: Fault{Latency: 200 * time.Millisecond}},
+		{in: "status=503", want: Fault{Status: 503}},
+		{in: "429,retry_after=2", want: Fault{Status: 429, RetryAfter: "2"}},
+		{in: " truncate , malformed ", want: Fault{Truncate: true, Malformed: true}},
+		{in: "empty,bomb,", want: Fault{Empty: true, Bomb: true}},
+		{in: "latency=soon", err: "invalid latency"},
+		{in: "latency", err: "invalid latency"},
+		{in: "status=99", err: "invalid status"},
+		{in: "status=600", err: "invalid status"},
+		{in: "status=abc", err: "invalid status"},
+		{in: "503=1", err: "unknown fault"},
+		{in: "timeout", err: "unknown fault"},
+	}
+	for _, tt := range tests {
+		got, err := ParseFault(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseFault(%q) error = %v, want it to contain %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseFault(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestServeHTTPRejectsHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"invalid json", `{"header":`, "invalid json"},
+		{"no header", `{}`, "header is missing"},
+		{"header not an object", `{"header":{"aid":"10000012"}}`, "invalid header"},
+		{"no aid", `{"header":{"user_unique_id":"1","os":"iOS","vendor_id":"v"}}`, "header.aid is missing"},
+		{"no user_unique_id", `{"header":{"aid":10000012,"os":"iOS","vendor_id":"v"}}`, "header.user_unique_id is missing"},
+		{"unknown os", `{"header":{"aid":10000012,"user_unique_id":"1","os":"symbian","vendor_id":"v"}}`, `header.os "symbian" is not supported`},
+		{"os not wire value", `{"header":{"aid":10000012,"user_unique_id":"1","os":"ios","vendor_id":"v"}}`, `header.os "ios" is not supported`},
+		{"no vendor_id", `{"header":{"aid":10000012,"user_unique_id":"1","os":"iOS","openudid":"o"}}`, "header.vendor_id is required for iOS"},
+		{"empty openudid", `{"header":{"aid":10000012,"user_unique_id":"1","os":"ANDROID","openudid":""}}`, "header.openudid is required for ANDROID"},
+		{"no web_id", `{"header":{"aid":10000012,"user_unique_id":"1","os":"web"}}`, "header.web_id is required for web"},
+	}
+	s := New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("POST", Path, strings.NewReader(tt.body)))
+
+			var res struct{ Message string }
+			json.Unmarshal(w.Body.Bytes(), &res)
+			if w.Code != http.StatusBadRequest || !strings.Contains(res.Message, tt.want) {
+				t.Errorf("response = %d %s, want 400 %q", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+
+	ok := `{"header":{"aid":10000012,"user_unique_id":"1","os":"iOS","vendor_id":"v"}}`
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", Path, strings.NewReader(ok)))
+	if w.Code != http.StatusOK {
+		t.Errorf("valid request = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestServeHTTPFaultFromRequest(t *testing.T) {
+	s := New()
+	body := `{"header":{"aid":10000012,"user_unique_id":"1","os":"iOS","vendor_id":"v"}}`
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		code   int
+	}{
+		{"header", Path, "429,retry_after=2", http.StatusTooManyRequests},
+		{"query", Path + "?fault=status%3D503", "", http.StatusServiceUnavailable},
+		{"invalid", Path, "status=abc", http.StatusBadRequest},
+		{"wrong path", "/service/2/app_log/", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.target, strings.NewReader(body))
+		if tt.header != "" {
+			req.Header.Set(FaultHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: response = %d %s, want %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package deviceregister
+
+import (
+	"code.byted.org/gopkg/logs"
+	"context"
+	"do_some_fxxking_test/deviceregister/spool"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrQueued 表示注册因为网络不可用没有完成，请求已经写入离线队列，之后由 ReplayQueued 重新注册
+var ErrQueued = errors.New("deviceregister: request queued for replay")
+
+// QueuedError 包装导致入队的原始错误，errors.Is(err, ErrQueued) 为 true，KindOf 返回原始错误的类别
+type QueuedError struct {
+	Err error
+}
+
+func (e *QueuedError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrQueued, e.Err)
+}
+
+func (e *QueuedError) Unwrap() error { return e.Err }
+
+func (e *QueuedError) Is(target error) bool { return target == ErrQueued }
+
+// WithOfflineQueue 在重试用完仍然因为网络错误、5xx、429 或熔断失败时，把请求写入 q 并返回 QueuedError，
+// 而不是直接失败。队列中的请求需要调用 ReplayQueued 重新注册。
+//
+// 失败的请求可能已经被服务端处理，所以队列保存的是已经发送过的请求体，
+// 重放时原样发送，udid 不变，由服务端按设备标识去重，不会产生重复的设备。
+func WithOfflineQueue(q *spool.Queue) Option {
+	return func(c *Client) {
+		c.offline = q
+	}
+}
+
+// queuedRequest 是离线队列中的一条记录
+type queuedRequest struct {
+	Request DeviceRegister `json:"request"`
+	// Body 是第一次发送的未压缩请求体
+	Body []byte `json:"body"`
+}
+
+// enqueue 把失败的请求和已经发送的请求体写入离线队列，写入失败时返回原始错误
+func (c *Client) enqueue(ctx context.Context, dr DeviceRegister, body []byte, tags map[string]string, err error) error {
+	// 调用方放弃的请求不入队
+	if c.offline == nil || ctx.Err() != nil || body == nil || !(IsRetryable(err) || errors.Is(err, ErrCircuitOpen)) {
+		return err
+	}
+
+	data, merr := json.Marshal(queuedRequest{Request: dr, Body: body})
+	if merr != nil {
+		return err
+	}
+	if perr := c.offline.Put(data); perr != nil {
+		logs.CtxErrorKvs(ctx, "msg", "enqueue register request failed", "err", perr)
+		return err
+	}
+
+	c.metrics.Counter(MetricQueued, 1, withTag(tags, "kind", KindOf(err).String()))
+	logs.CtxWarnKvs(ctx, "msg", "register request queued for replay", "kind", KindOf(err))
+	return &QueuedError{Err: err}
+}
+
+// ReplayQueued 持续从离线队列取出请求重新注册，直到 ctx 结束，返回 ctx.Err()。
+// 请求体与入队前发送的逐字节相同，队列在重启后重复投递的请求也不会注册出新设备。
+// 每个请求完成后调用 fn；仍然因为网络等原因失败的请求放回队首，等待 retry 后再试，
+// 不可重试的失败会交给 fn 并从队列中删除。
+func (c *Client) ReplayQueued(ctx context.Context, retry time.Duration, fn func(DeviceRegister, *Response, error)) error {
+	if c.offline == nil {
+		return errors.New("deviceregister: offline queue is not configured")
+	}
+
+	for {
+		item, err := c.offline.Get(ctx)
+		if err != nil {
+			return err
+		}
+
+		var qr queuedRequest
+		if err := json.Unmarshal(item.Data, &qr); err != nil || len(qr.Body) == 0 {
+			logs.CtxErrorKvs(ctx, "msg", "drop corrupt queued register request", "id", item.ID, "err", err)
+			c.offline.Ack(item.ID)
+			continue
+		}
+		dr := qr.Request
+
+		res, err := c.registerDevice(ctx, dr, qr.Body, false)
+		if err != nil && ctx.Err() != nil {
+			c.offline.Nack(item.ID)
+			return ctx.Err()
+		}
+		if err != nil && (IsRetryable(err) || errors.Is(err, ErrCircuitOpen)) {
+			c.offline.Nack(item.ID)
+			if err := sleepCtx(ctx, retry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := c.offline.Ack(item.ID); err != nil {
+			logs.CtxErrorKvs(ctx, "msg", "ack queued register request failed", "id", item.ID, "err", err)
+		}
+		if fn != nil {
+			fn(dr, res, err)
+		}
+	}
+}
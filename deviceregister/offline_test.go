@@ -0,0 +1,96 @@
+package deviceregister_test
+
+import (
+	"bytes"
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"do_some_fxxking_test/deviceregister/spool"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bodyRecorder 记录收到的请求头和请求体后交给 next 处理
+type bodyRecorder struct {
+	next http.Handler
+
+	mu      sync.Mutex
+	bodies  [][]byte
+	headers []http.Header
+}
+
+func (b *bodyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	b.mu.Lock()
+	b.bodies = append(b.bodies, body)
+	b.headers = append(b.headers, r.Header.Clone())
+	b.mu.Unlock()
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	b.next.ServeHTTP(w, r)
+}
+
+func openSpool(t *testing.T) *spool.Queue {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := spool.Open(dir, spool.Options{NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		q.Close()
+		os.RemoveAll(dir)
+	})
+	return q
+}
+
+func TestReplayQueuedSendsSameBody(t *testing.T) {
+	s := mockserver.New()
+	rec := &bodyRecorder{next: s}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+	s.Script(mockserver.Fault{Status: http.StatusBadGateway})
+
+	c := testClient(t, ts.URL,
+		deviceregister.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 1}),
+		deviceregister.WithOfflineQueue(openSpool(t)))
+
+	_, err := c.Register(context.Background(), testDevice())
+	if !errors.Is(err, deviceregister.ErrQueued) {
+		t.Fatalf("Register error = %v, want ErrQueued", err)
+	}
+	if k := deviceregister.KindOf(err); k != deviceregister.KindStatus {
+		t.Errorf("KindOf(%v) = %v, want %v", err, k, deviceregister.KindStatus)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var (
+		res    *deviceregister.Response
+		replay error
+	)
+	c.ReplayQueued(ctx, time.Millisecond, func(dr deviceregister.DeviceRegister, r *deviceregister.Response, err error) {
+		res, replay = r, err
+		cancel()
+	})
+	if replay != nil || res == nil || res.DeviceId == 0 {
+		t.Fatalf("replay = %+v, %v, want a registered device", res, replay)
+	}
+
+	if len(rec.bodies) != 2 {
+		t.Fatalf("server got %d requests, want 2", len(rec.bodies))
+	}
+	if !bytes.Equal(rec.bodies[0], rec.bodies[1]) {
+		t.Errorf("replayed body differs from the original:\n%s\n%s", rec.bodies[0], rec.bodies[1])
+	}
+}
@@ -0,0 +1,166 @@
+package deviceregister
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Platform 描述一个客户端平台在 device_register 中的约定
+type Platform struct {
+	// Name 是规范名，小写，如 ios
+	Name string
+	// Aliases 是 Name 之外可以识别的输入，大小写不敏感
+	Aliases []string
+	// WireOs 是请求体中 os 字段的枚举值，如 iOS
+	WireOs string
+	// IdentifierField 是设备标识在请求体中的字段名，如 vendor_id
+	IdentifierField string
+	// OsVersion 校验 Profile.OsVersion，为 nil 时不校验
+	OsVersion *regexp.Regexp
+	// OsVersionExample 用于校验失败时的提示
+	OsVersionExample string
+}
+
+var (
+	platformMu sync.RWMutex
+	// platformByInput 以小写的 Name 和 Aliases 为 key
+	platformByInput = make(map[string]Platform)
+	platformByWire  = make(map[string]Platform)
+)
+
+func init() {
+	for _, p := range []Platform{
+		{
+			Name:             "ios",
+			Aliases:          []string{"iphone", "ipad", "ipados"},
+			WireOs:           "iOS",
+			IdentifierField:  "vendor_id",
+			OsVersion:        regexp.MustCompile(`^\d{1,2}(\.\d+){1,2}$`),
+			OsVersionExample: "14.2 or 16.0.1",
+		},
+		{
+			Name:             "android",
+			WireOs:           "ANDROID",
+			IdentifierField:  "openudid",
+			OsVersion:        regexp.MustCompile(`^\d{1,2}(\.\d+){0,2}$`),
+			OsVersionExample: "11 or 8.1.0",
+		},
+		{
+			Name:             "harmony",
+			Aliases:          []string{"harmonyos", "ohos", "openharmony"},
+			WireOs:           "HarmonyOS",
+			IdentifierField:  "openudid",
+			OsVersion:        regexp.MustCompile(`^\d{1,2}(\.\d+){0,3}$`),
+			OsVersionExample: "4.0 or 3.0.0.1",
+		},
+		{
+			Name:             "macos",
+			Aliases:          []string{"mac", "osx", "macosx", "darwin"},
+			WireOs:           "macOS",
+			IdentifierField:  "vendor_id",
+			OsVersion:        regexp.MustCompile(`^\d{2}(\.\d+){0,2}$`),
+			OsVersionExample: "10.15.7 or 13",
+		},
+		{
+			Name:             "windows",
+			Aliases:          []string{"win", "win32", "win64"},
+			WireOs:           "Windows",
+			IdentifierField:  "device_unique_id",
+			OsVersion:        regexp.MustCompile(`^\d{1,2}(\.\d+){0,3}$`),
+			OsVersionExample: "10 or 10.0.19045",
+		},
+		{
+			Name:            "web",
+			Aliases:         []string{"h5", "browser", "wap"},
+			WireOs:          "web",
+			IdentifierField: "web_id",
+		},
+	} {
+		if err := RegisterPlatform(p); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterPlatform 注册或替换一个平台，Name、Aliases 和 WireOs 不能与其他平台冲突
+func RegisterPlatform(p Platform) error {
+	if p.Name == "" || p.WireOs == "" || p.IdentifierField == "" {
+		return errors.New("deviceregister: platform name, wire os and identifier field are required")
+	}
+
+	name := strings.ToLower(p.Name)
+	inputs := []string{name}
+	for _, a := range p.Aliases {
+		inputs = append(inputs, strings.ToLower(a))
+	}
+
+	platformMu.Lock()
+	defer platformMu.Unlock()
+
+	for _, in := range inputs {
+		if old, ok := platformByInput[in]; ok && old.Name != name {
+			return fmt.Errorf("deviceregister: platform input %q is already used by %s", in, old.Name)
+		}
+	}
+	// 否则 LookupWireOs 会把服务端返回的 os 识别成后注册的平台
+	if old, ok := platformByWire[p.WireOs]; ok && old.Name != name {
+		return fmt.Errorf("deviceregister: platform wire os %q is already used by %s", p.WireOs, old.Name)
+	}
+
+	// 替换时先删除旧平台的所有输入
+	if old, ok := platformByInput[name]; ok {
+		delete(platformByWire, old.WireOs)
+		for in, q := range platformByInput {
+			if q.Name == old.Name {
+				delete(platformByInput, in)
+			}
+		}
+	}
+
+	p.Name = name
+	for _, in := range inputs {
+		platformByInput[in] = p
+	}
+	platformByWire[p.WireOs] = p
+
+	return nil
+}
+
+// LookupPlatform 按名称或别名查找平台，大小写不敏感，未知平台返回 ValidationError
+func LookupPlatform(os string) (Platform, error) {
+	platformMu.RLock()
+	p, ok := platformByInput[strings.ToLower(strings.TrimSpace(os))]
+	platformMu.RUnlock()
+
+	if !ok {
+		return Platform{}, invalidField("os", "%q is not a known platform, expect one of %s", os, strings.Join(Platforms(), ", "))
+	}
+	return p, nil
+}
+
+// LookupWireOs 按请求体中的 os 枚举值查找平台，大小写敏感
+func LookupWireOs(wireOs string) (Platform, bool) {
+	platformMu.RLock()
+	defer platformMu.RUnlock()
+
+	p, ok := platformByWire[wireOs]
+	return p, ok
+}
+
+// Platforms 返回所有平台的规范名
+func Platforms() []string {
+	platformMu.RLock()
+	defer platformMu.RUnlock()
+
+	names := make([]string, 0, len(platformByWire))
+	for _, p := range platformByWire {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,124 @@
+package deviceregister_test
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLookupPlatform(t *testing.T) {
+	tests := []struct {
+		input      string
+		name       string
+		wireOs     string
+		identifier string
+	}{
+		{"ios", "ios", "iOS", "vendor_id"},
+		{"IOS", "ios", "iOS", "vendor_id"},
+		{" iPhone ", "ios", "iOS", "vendor_id"},
+		{"iPadOS", "ios", "iOS", "vendor_id"},
+		{"Android", "android", "ANDROID", "openudid"},
+		{"harmony", "harmony", "HarmonyOS", "openudid"},
+		{"ohos", "harmony", "HarmonyOS", "openudid"},
+		{"OpenHarmony", "harmony", "HarmonyOS", "openudid"},
+		{"macOS", "macos", "macOS", "vendor_id"},
+		{"darwin", "macos", "macOS", "vendor_id"},
+		{"Win64", "windows", "Windows", "device_unique_id"},
+		{"H5", "web", "web", "web_id"},
+		{"browser", "web", "web", "web_id"},
+	}
+	for _, tt := range tests {
+		p, err := deviceregister.LookupPlatform(tt.input)
+		if err != nil {
+			t.Errorf("LookupPlatform(%q): %v", tt.input, err)
+			continue
+		}
+		if p.Name != tt.name || p.WireOs != tt.wireOs || p.IdentifierField != tt.identifier {
+			t.Errorf("LookupPlatform(%q) = %s/%s/%s, want %s/%s/%s",
+				tt.input, p.Name, p.WireOs, p.IdentifierField, tt.name, tt.wireOs, tt.identifier)
+		}
+		if w, ok := deviceregister.LookupWireOs(tt.wireOs); !ok || w.Name != tt.name {
+			t.Errorf("LookupWireOs(%q) = %+v, %v, want %s", tt.wireOs, w, ok, tt.name)
+		}
+	}
+}
+
+func TestLookupPlatformUnknown(t *testing.T) {
+	for _, input := range []string{"", "iso", "andriod", "symbian", "i os"} {
+		_, err := deviceregister.LookupPlatform(input)
+		var ve *deviceregister.ValidationError
+		if !errors.As(err, &ve) || ve.Field != "os" || !errors.Is(err, deviceregister.ErrInvalidRequest) {
+			t.Errorf("LookupPlatform(%q) = %v, want a ValidationError for os", input, err)
+			continue
+		}
+		// 错误信息列出所有可用的平台
+		if !strings.Contains(ve.Reason, strings.Join(deviceregister.Platforms(), ", ")) {
+			t.Errorf("LookupPlatform(%q) reason %q does not list the platforms", input, ve.Reason)
+		}
+	}
+	// 请求体里的枚举值大小写敏感
+	if _, ok := deviceregister.LookupWireOs("ios"); ok {
+		t.Error("LookupWireOs(ios) matched, want the exact iOS")
+	}
+}
+
+func TestRegisterPlatformsOnTheWire(t *testing.T) {
+	s := mockserver.New()
+	rec := &bodyRecorder{next: s}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+	c := testClient(t, ts.URL)
+
+	for i, input := range []string{"IOS", "android", "ohos", "mac", "win", "web"} {
+		p, err := deviceregister.LookupPlatform(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dr := deviceregister.DeviceRegister{UserUniqueId: "276095447832965", AppId: 10000012, Os: input}
+		if _, err := c.Register(context.Background(), dr); err != nil {
+			t.Errorf("Register(%s): %v", input, err)
+			continue
+		}
+
+		var body struct{ Header map[string]interface{} }
+		if err := json.Unmarshal(rec.bodies[i], &body); err != nil {
+			t.Fatal(err)
+		}
+		if os := body.Header["os"]; os != p.WireOs {
+			t.Errorf("%s: header.os = %v, want %s", input, os, p.WireOs)
+		}
+		if id, _ := body.Header[p.IdentifierField].(string); id == "" {
+			t.Errorf("%s: header.%s is empty", input, p.IdentifierField)
+		}
+	}
+}
+
+func TestRegisterPlatformConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		p    deviceregister.Platform
+	}{
+		{"name used as alias", deviceregister.Platform{Name: "iphone", WireOs: "iPhoneOS", IdentifierField: "vendor_id"}},
+		{"alias", deviceregister.Platform{Name: "tvos", Aliases: []string{"mac"}, WireOs: "tvOS", IdentifierField: "vendor_id"}},
+		{"wire os", deviceregister.Platform{Name: "ipados2", WireOs: "iOS", IdentifierField: "vendor_id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := deviceregister.RegisterPlatform(tt.p); err == nil {
+				t.Errorf("RegisterPlatform(%+v) succeeded, want a conflict error", tt.p)
+			}
+		})
+	}
+
+	if p, ok := deviceregister.LookupWireOs("iOS"); !ok || p.Name != "ios" {
+		t.Errorf("LookupWireOs(iOS) = %+v, %v, want ios", p, ok)
+	}
+	if _, err := deviceregister.LookupPlatform("ipados2"); err == nil {
+		t.Error("rejected platform ipados2 was registered")
+	}
+}
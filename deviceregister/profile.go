@@ -0,0 +1,123 @@
+package deviceregister
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Profile 是可选的设备信息，会合并到请求体的 header 中
+type Profile struct {
+	DeviceModel string `json:"device_model,omitempty"`
+	OsVersion   string `json:"os_version,omitempty"`
+	AppVersion  string `json:"app_version,omitempty"`
+	Channel     string `json:"channel,omitempty"`
+	// Resolution 形如 1080x1920
+	Resolution string `json:"resolution,omitempty"`
+	// Language 形如 zh、en-US
+	Language string `json:"language,omitempty"`
+	// Timezone 是相对 UTC 的小时数，nil 表示不发送
+	Timezone *int `json:"timezone,omitempty"`
+	// Region 是两位大写国家码，如 CN
+	Region string `json:"region,omitempty"`
+	// Custom 中的字段原样透传，但不能覆盖已有字段
+	Custom map[string]interface{} `json:"custom,omitempty"`
+}
+
+var (
+	appVersionRe = regexp.MustCompile(`^\d+(\.\d+)*$`)
+	resolutionRe = regexp.MustCompile(`^[1-9]\d*x[1-9]\d*$`)
+	languageRe   = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+	regionRe     = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// reservedKeys 是 generateBody 自己会填的字段，Custom 不能使用，平台的标识字段另外检查
+var reservedKeys = map[string]bool{
+	"aid": true, "user_unique_id": true, "os": true,
+	"device_model": true, "os_version": true, "app_version": true, "channel": true,
+	"resolution": true, "language": true, "timezone": true, "region": true,
+}
+
+// validate 按平台校验各字段的格式
+func (p *Profile) validate(platform Platform) error {
+	if p.OsVersion != "" && platform.OsVersion != nil && !platform.OsVersion.MatchString(p.OsVersion) {
+		return invalidField("profile.os_version", "%q is not a valid %s version, expect %s",
+			p.OsVersion, platform.WireOs, platform.OsVersionExample)
+	}
+	if p.AppVersion != "" && !appVersionRe.MatchString(p.AppVersion) {
+		return invalidField("profile.app_version", "%q is not dotted numbers", p.AppVersion)
+	}
+	if p.Resolution != "" && !resolutionRe.MatchString(p.Resolution) {
+		return invalidField("profile.resolution", "%q is not WIDTHxHEIGHT", p.Resolution)
+	}
+	if p.Language != "" && !languageRe.MatchString(p.Language) {
+		return invalidField("profile.language", "%q is not a language tag", p.Language)
+	}
+	if p.Timezone != nil && (*p.Timezone < -12 || *p.Timezone > 14) {
+		return invalidField("profile.timezone", "%d is out of [-12, 14]", *p.Timezone)
+	}
+	if p.Region != "" && !regionRe.MatchString(p.Region) {
+		return invalidField("profile.region", "%q is not a two letter upper case country code", p.Region)
+	}
+	for k := range p.Custom {
+		if k == "" || reservedKeys[k] || k == platform.IdentifierField {
+			return invalidField("profile.custom", "key %q is reserved", k)
+		}
+	}
+
+	return nil
+}
+
+// fill 把非空字段写入 header
+func (p *Profile) fill(body map[string]interface{}) {
+	for k, v := range p.Custom {
+		body[k] = v
+	}
+
+	set := func(k, v string) {
+		if v != "" {
+			body[k] = v
+		}
+	}
+	set("device_model", p.DeviceModel)
+	set("os_version", p.OsVersion)
+	set("app_version", p.AppVersion)
+	set("channel", p.Channel)
+	set("resolution", p.Resolution)
+	set("language", p.Language)
+	set("region", p.Region)
+	if p.Timezone != nil {
+		body["timezone"] = *p.Timezone
+	}
+}
+
+// Validate 在发送前检查请求是否合法
+func (dr DeviceRegister) Validate() error {
+	_, err := dr.platform()
+	return err
+}
+
+// platform 校验请求并返回其平台
+func (dr DeviceRegister) platform() (Platform, error) {
+	if dr.UserUniqueId == "" {
+		return Platform{}, invalidField("user_unique_id", "is empty")
+	}
+	if dr.AppId == 0 {
+		return Platform{}, invalidField("app_id", "is empty")
+	}
+
+	p, err := LookupPlatform(dr.Os)
+	if err != nil {
+		return Platform{}, err
+	}
+	if dr.Profile != nil {
+		if err := dr.Profile.validate(p); err != nil {
+			return Platform{}, err
+		}
+	}
+
+	return p, nil
+}
+
+func invalidField(field, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
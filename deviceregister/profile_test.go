@@ -0,0 +1,94 @@
+package deviceregister_test
+
+import (
+	"do_some_fxxking_test/deviceregister"
+	"errors"
+	"testing"
+)
+
+func TestProfileValidate(t *testing.T) {
+	tz := func(h int) *int { return &h }
+	tests := []struct {
+		name    string
+		os      string
+		profile deviceregister.Profile
+		// field 是期望出错的字段，为空表示合法
+		field string
+	}{
+		{"ios version", "ios", deviceregister.Profile{OsVersion: "16.0.1"}, ""},
+		{"ios major only", "ios", deviceregister.Profile{OsVersion: "16"}, "profile.os_version"},
+		{"ios four parts", "ios", deviceregister.Profile{OsVersion: "16.0.1.2"}, "profile.os_version"},
+		{"android major only", "android", deviceregister.Profile{OsVersion: "11"}, ""},
+		{"android with suffix", "android", deviceregister.Profile{OsVersion: "11-beta"}, "profile.os_version"},
+		{"harmony four parts", "harmony", deviceregister.Profile{OsVersion: "3.0.0.1"}, ""},
+		{"macos two digit major", "macos", deviceregister.Profile{OsVersion: "10.15.7"}, ""},
+		{"macos one digit major", "macos", deviceregister.Profile{OsVersion: "9.2"}, "profile.os_version"},
+		{"windows build", "windows", deviceregister.Profile{OsVersion: "10.0.19045"}, ""},
+		{"web has no version rule", "web", deviceregister.Profile{OsVersion: "Chrome 120"}, ""},
+
+		{"app version", "ios", deviceregister.Profile{AppVersion: "1.2.30"}, ""},
+		{"app version with v", "ios", deviceregister.Profile{AppVersion: "v1.2"}, "profile.app_version"},
+		{"resolution", "ios", deviceregister.Profile{Resolution: "1080x1920"}, ""},
+		{"resolution with zero", "ios", deviceregister.Profile{Resolution: "0x1920"}, "profile.resolution"},
+		{"resolution with star", "ios", deviceregister.Profile{Resolution: "1080*1920"}, "profile.resolution"},
+		{"language", "ios", deviceregister.Profile{Language: "zh"}, ""},
+		{"language with region", "ios", deviceregister.Profile{Language: "en-US"}, ""},
+		{"language upper case", "ios", deviceregister.Profile{Language: "ZH"}, "profile.language"},
+		{"region", "ios", deviceregister.Profile{Region: "CN"}, ""},
+		{"region lower case", "ios", deviceregister.Profile{Region: "cn"}, "profile.region"},
+		{"region three letters", "ios", deviceregister.Profile{Region: "CHN"}, "profile.region"},
+
+		{"timezone min", "ios", deviceregister.Profile{Timezone: tz(-12)}, ""},
+		{"timezone max", "ios", deviceregister.Profile{Timezone: tz(14)}, ""},
+		{"timezone zero", "ios", deviceregister.Profile{Timezone: tz(0)}, ""},
+		{"timezone below", "ios", deviceregister.Profile{Timezone: tz(-13)}, "profile.timezone"},
+		{"timezone above", "ios", deviceregister.Profile{Timezone: tz(15)}, "profile.timezone"},
+
+		{"custom", "ios", deviceregister.Profile{Custom: map[string]interface{}{"carrier": "cmcc"}}, ""},
+		{"custom reserved", "ios", deviceregister.Profile{Custom: map[string]interface{}{"aid": 1}}, "profile.custom"},
+		{"custom profile field", "ios", deviceregister.Profile{Custom: map[string]interface{}{"os_version": "1"}}, "profile.custom"},
+		{"custom empty key", "ios", deviceregister.Profile{Custom: map[string]interface{}{"": 1}}, "profile.custom"},
+		{"custom identifier", "ios", deviceregister.Profile{Custom: map[string]interface{}{"vendor_id": "x"}}, "profile.custom"},
+		{"custom identifier of android", "android", deviceregister.Profile{Custom: map[string]interface{}{"openudid": "x"}}, "profile.custom"},
+		// 其他平台的标识字段可以透传
+		{"custom identifier of another platform", "ios", deviceregister.Profile{Custom: map[string]interface{}{"openudid": "x"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := tt.profile
+			dr := deviceregister.DeviceRegister{UserUniqueId: "276095447832965", AppId: 10000012, Os: tt.os, Profile: &profile}
+			err := dr.Validate()
+			if tt.field == "" {
+				if err != nil {
+					t.Errorf("Validate: %v", err)
+				}
+				return
+			}
+
+			var ve *deviceregister.ValidationError
+			if !errors.As(err, &ve) || ve.Field != tt.field {
+				t.Errorf("Validate = %v, want a ValidationError for %s", err, tt.field)
+			}
+			if !errors.Is(err, deviceregister.ErrInvalidRequest) {
+				t.Errorf("Validate = %v, want ErrInvalidRequest", err)
+			}
+		})
+	}
+}
+
+func TestValidateRequiredFields(t *testing.T) {
+	tests := []struct {
+		dr    deviceregister.DeviceRegister
+		field string
+	}{
+		{deviceregister.DeviceRegister{AppId: 10000012, Os: "ios"}, "user_unique_id"},
+		{deviceregister.DeviceRegister{UserUniqueId: "1", Os: "ios"}, "app_id"},
+		{deviceregister.DeviceRegister{UserUniqueId: "1", AppId: 10000012}, "os"},
+	}
+	for _, tt := range tests {
+		var ve *deviceregister.ValidationError
+		if err := tt.dr.Validate(); !errors.As(err, &ve) || ve.Field != tt.field {
+			t.Errorf("Validate(%+v) = %v, want a ValidationError for %s", tt.dr, err, tt.field)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package deviceregister
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// 不同版本的私有化服务返回的 Response 字段类型不一致：
+// device_id、install_id 可能是数字、字符串或只有 *_str，new_user 可能缺失或是 bool。
+// decodeResponse 兼容这些格式，无法识别的值和未知、缺失的字段作为 warning 返回，不导致解码失败。
+
+// requiredFields 是缺失时需要报 warning 的字段，device_id 和 install_id 有 *_str 之一即可
+var requiredFields = []string{"device_id", "install_id", "new_user"}
+
+// decodeResponse 解析 device_register 的返回，只有 body 不是 JSON 对象时返回错误
+func decodeResponse(body []byte) (*Response, []string, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
+	if _, ok := err.(*json.UnmarshalTypeError); ok || (err == nil && fields == nil) {
+		return nil, nil, errors.New("response is not a JSON object")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d := responseDecoder{fields: fields}
+	res := &Response{
+		BdDid:      d.string("bd_did"),
+		Cd:         d.string("cd"),
+		Ssid:       d.string("ssid"),
+		NewUser:    d.newUser("new_user"),
+		ServerTime: d.uint64("server_time"),
+	}
+	res.DeviceId, _ = d.id("device_id")
+	res.InstallId, res.InstallIdStr = d.id("install_id")
+
+	for _, name := range requiredFields {
+		if !d.present(name) && !d.present(name+"_str") {
+			d.warnf("missing field %q", name)
+		}
+	}
+
+	var unknown []string
+	for name := range fields {
+		if !d.seen[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		d.warnf("unknown field %q", name)
+	}
+
+	return res, d.warnings, nil
+}
+
+type responseDecoder struct {
+	fields   map[string]json.RawMessage
+	seen     map[string]bool
+	warnings []string
+}
+
+func (d *responseDecoder) warnf(format string, args ...interface{}) {
+	d.warnings = append(d.warnings, fmt.Sprintf(format, args...))
+}
+
+// raw 返回字段的原始值并标记为已知字段，null 视为缺失
+func (d *responseDecoder) raw(name string) (json.RawMessage, bool) {
+	if d.seen == nil {
+		d.seen = make(map[string]bool)
+	}
+	d.seen[name] = true
+
+	v, ok := d.fields[name]
+	if !ok || bytes.Equal(v, []byte("null")) {
+		return nil, false
+	}
+	return v, true
+}
+
+func (d *responseDecoder) present(name string) bool {
+	_, ok := d.raw(name)
+	return ok
+}
+
+// text 返回字符串的内容或数字的原文，其他类型返回 false
+func (d *responseDecoder) text(name string) (string, bool) {
+	v, ok := d.raw(name)
+	if !ok {
+		return "", false
+	}
+
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		return s, true
+	}
+	var n json.Number
+	if err := json.Unmarshal(v, &n); err == nil {
+		return n.String(), true
+	}
+
+	d.warnf("field %q has unexpected value %s", name, v)
+	return "", false
+}
+
+func (d *responseDecoder) string(name string) string {
+	s, _ := d.text(name)
+	return s
+}
+
+// uint64 直接解析数字原文，不经过 float64，超过 2^53 的 ID 也不会丢失精度
+func (d *responseDecoder) uint64(name string) uint64 {
+	s, ok := d.text(name)
+	if !ok || s == "" {
+		return 0
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		d.warnf("field %q is not an unsigned integer: %q", name, s)
+		return 0
+	}
+	return n
+}
+
+// id 合并 name 和 name_str，两者不一致时以 name_str 为准，它不会在服务端或中间代理被转成 float
+func (d *responseDecoder) id(name string) (uint64, string) {
+	n := d.uint64(name)
+	s := d.uint64(name + "_str")
+
+	switch {
+	case s == 0:
+		s = n
+	case n != 0 && n != s:
+		d.warnf("field %q is %d but %q is %d, using %q", name, n, name+"_str", s, name+"_str")
+	}
+
+	if s == 0 {
+		return 0, ""
+	}
+	return s, strconv.FormatUint(s, 10)
+}
+
+// newUser 接受 0/1、bool 和它们的字符串形式
+func (d *responseDecoder) newUser(name string) uint8 {
+	v, ok := d.raw(name)
+	if !ok {
+		return 0
+	}
+
+	var b bool
+	if err := json.Unmarshal(v, &b); err == nil {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	switch s, _ := d.text(name); s {
+	case "1", "true":
+		return 1
+	case "0", "false", "":
+		return 0
+	default:
+		d.warnf("field %q is %s, expect 0, 1 or bool", name, v)
+		return 0
+	}
+}
@@ -0,0 +1,84 @@
+package deviceregister
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		want     Response
+		warnings []string
+	}{
+		{
+			name: "numbers",
+			body: `{"device_id":4256394634101069489,"install_id":1308745862428913748,"bd_did":"3BE0","cd":"36cc","new_user":1,"ssid":"s","server_time":1606809600}`,
+			want: Response{DeviceId: 4256394634101069489, InstallId: 1308745862428913748, InstallIdStr: "1308745862428913748",
+				BdDid: "3BE0", Cd: "36cc", NewUser: 1, Ssid: "s", ServerTime: 1606809600},
+		},
+		{
+			name: "strings and bool",
+			body: `{"device_id":"4256394634101069489","install_id":"1308745862428913748","new_user":true}`,
+			want: Response{DeviceId: 4256394634101069489, InstallId: 1308745862428913748, InstallIdStr: "1308745862428913748", NewUser: 1},
+		},
+		{
+			name: "only str fields",
+			body: `{"device_id_str":"4256394634101069489","install_id_str":"1308745862428913748","new_user":"false"}`,
+			want: Response{DeviceId: 4256394634101069489, InstallId: 1308745862428913748, InstallIdStr: "1308745862428913748"},
+		},
+		{
+			name: "str wins on conflict",
+			body: `{"device_id":4256394634101069000,"device_id_str":"4256394634101069489","install_id":1,"new_user":0}`,
+			want: Response{DeviceId: 4256394634101069489, InstallId: 1, InstallIdStr: "1"},
+			warnings: []string{
+				`field "device_id" is 4256394634101069000 but "device_id_str" is 4256394634101069489, using "device_id_str"`,
+			},
+		},
+		{
+			name: "missing and unknown",
+			body: `{"device_id":1,"bd_did":"b","extra":true,"another":null}`,
+			want: Response{DeviceId: 1, BdDid: "b"},
+			warnings: []string{
+				`missing field "install_id"`,
+				`missing field "new_user"`,
+				`unknown field "another"`,
+				`unknown field "extra"`,
+			},
+		},
+		{
+			name: "unexpected values",
+			body: `{"device_id":-1,"install_id":{"id":1},"new_user":"maybe","bd_did":["b"]}`,
+			want: Response{},
+			warnings: []string{
+				`field "bd_did" has unexpected value ["b"]`,
+				`field "new_user" is "maybe", expect 0, 1 or bool`,
+				`field "device_id" is not an unsigned integer: "-1"`,
+				`field "install_id" has unexpected value {"id":1}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, warnings, err := decodeResponse([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("decodeResponse: %v", err)
+			}
+			if *res != tt.want {
+				t.Errorf("response = %+v, want %+v", *res, tt.want)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestDecodeResponseNotObject(t *testing.T) {
+	for _, body := range []string{`[]`, `null`, `"ok"`, `1`, `{"device_id":`} {
+		if _, _, err := decodeResponse([]byte(body)); err == nil {
+			t.Errorf("decodeResponse(%s) succeeded, want an error", body)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package deviceregister
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy 控制 Register 的重试行为。
+// 超时等网络错误、5xx 和 429 会重试，429/503 带 Retry-After 时至少等待其给出的时间，
+// Retry-After 超过上限时不再重试，直接返回 StatusError。
+type RetryPolicy struct {
+	// MaxAttempts 是包括第一次在内的最大尝试次数，小于 1 时按 1 处理
+	MaxAttempts int
+	// BaseDelay 是第一次重试前的等待时间，之后每次翻倍
+	BaseDelay time.Duration
+	// MaxDelay 是指数退避和 Retry-After 的上限，为 0 时指数退避没有上限，Retry-After 的上限是 DefaultMaxRetryAfter
+	MaxDelay time.Duration
+	// Jitter 取值 [0, 1]，每次等待会随机减少最多 Jitter 比例的时间
+	Jitter float64
+}
+
+// DefaultMaxRetryAfter 是 MaxDelay 为 0 时愿意等待的最长 Retry-After
+const DefaultMaxRetryAfter = 30 * time.Second
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond * 200,
+		MaxDelay:    time.Second * 5,
+		Jitter:      0.2,
+	}
+}
+
+// WithRetryPolicy 设置重试策略，MaxAttempts 为 1 表示不重试
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// Validate 检查延迟和抖动的取值范围
+func (p RetryPolicy) Validate() error {
+	if p.BaseDelay < 0 || p.MaxDelay < 0 {
+		return fmt.Errorf("deviceregister: retry delays must not be negative, got base %v max %v", p.BaseDelay, p.MaxDelay)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("deviceregister: retry jitter must be in [0, 1], got %v", p.Jitter)
+	}
+
+	return nil
+}
+
+// Backoff 返回第 attempt 次失败后的等待时间，attempt 从 1 开始
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(float64(d) * p.Jitter * rand.Float64())
+	}
+
+	return d
+}
+
+// RetryDelay 返回第 attempt 次失败 err 之后的等待时间，err 带有 Retry-After 时至少等待其给出的时间。
+// Retry-After 超过上限时返回 false，调用方应当放弃重试
+func (p RetryPolicy) RetryDelay(attempt int, err error) (time.Duration, bool) {
+	delay := p.Backoff(attempt)
+
+	var se *StatusError
+	if !errors.As(err, &se) || se.RetryAfter <= delay {
+		return delay, true
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = DefaultMaxRetryAfter
+	}
+	if se.RetryAfter > max {
+		return 0, false
+	}
+
+	return se.RetryAfter, true
+}
+
+// Attempts 返回包括第一次在内的最大尝试次数
+func (p RetryPolicy) Attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// retryable 判断一次失败是否值得重试。
+// 单次请求超时（http.Client.Timeout）的错误链里也可能有 context.DeadlineExceeded，
+// 所以这里不检查它，调用方的 ctx 是否结束由调用方用 ctx.Err() 判断。
+// Transport 返回的 ErrInvalidRequest（如回放时没有匹配的录制）重试也不会成功。
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrInvalidRequest) {
+		return false
+	}
+
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 || se.StatusCode == http.StatusTooManyRequests
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, ErrTransport)
+}
+
+// ParseRetryAfter 解析 Retry-After，支持秒数和 HTTP 日期两种格式
+func ParseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
+// sleepCtx 等待 d，ctx 结束时提前返回 ctx.Err()
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
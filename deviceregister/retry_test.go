@@ -0,0 +1,214 @@
+package deviceregister_test
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func testDevice() deviceregister.DeviceRegister {
+	return deviceregister.DeviceRegister{
+		UserUniqueId: "276095447832965",
+		AppId:        10000012,
+		Os:           "ios",
+		Profile: &deviceregister.Profile{
+			DeviceModel: "iPhone12,1",
+			OsVersion:   "14.2",
+			AppVersion:  "1.0.0",
+			Language:    "zh",
+			Region:      "CN",
+		},
+	}
+}
+
+func testClient(t *testing.T, url string, opts ...deviceregister.Option) *deviceregister.Client {
+	t.Helper()
+
+	c, err := deviceregister.NewClient(append([]deviceregister.Option{deviceregister.WithEndpoint(url + mockserver.Path)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"transport", &deviceregister.TransportError{Err: errors.New("connection refused")}, true},
+		{"net timeout", timeoutError{}, true},
+		{"client timeout", &deviceregister.TransportError{Err: fmt.Errorf("Client.Timeout exceeded: %w", context.DeadlineExceeded)}, true},
+		{"canceled", &deviceregister.TransportError{Err: context.Canceled}, false},
+		{"500", &deviceregister.StatusError{StatusCode: 500}, true},
+		{"503", &deviceregister.StatusError{StatusCode: 503}, true},
+		{"429", &deviceregister.StatusError{StatusCode: 429}, true},
+		{"400", &deviceregister.StatusError{StatusCode: 400}, false},
+		{"decode", &deviceregister.DecodeError{Err: errors.New("eof")}, false},
+		{"validation", &deviceregister.ValidationError{Field: "aid", Reason: "must not be zero"}, false},
+		{"plain", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deviceregister.IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 12, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{now.Add(2 * time.Second).Format(http.TimeFormat), 2 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := deviceregister.ParseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := deviceregister.RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 300 * time.Millisecond},
+		{4, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := p.Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retryAfter := func(d time.Duration) error {
+		return &deviceregister.StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: d}
+	}
+	tests := []struct {
+		name   string
+		policy deviceregister.RetryPolicy
+		err    error
+		want   time.Duration
+		ok     bool
+	}{
+		{"backoff", deviceregister.RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, timeoutError{}, 100 * time.Millisecond, true},
+		{"shorter retry after", deviceregister.RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, retryAfter(time.Millisecond), 100 * time.Millisecond, true},
+		{"longer retry after", deviceregister.RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, retryAfter(time.Second), time.Second, true},
+		{"over max delay", deviceregister.RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, retryAfter(86400 * time.Second), 0, false},
+		{"default max", deviceregister.RetryPolicy{BaseDelay: 100 * time.Millisecond}, retryAfter(deviceregister.DefaultMaxRetryAfter), deviceregister.DefaultMaxRetryAfter, true},
+		{"over default max", deviceregister.RetryPolicy{BaseDelay: 100 * time.Millisecond}, retryAfter(time.Hour), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.policy.RetryDelay(1, tt.err)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("RetryDelay = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRegisterRetryAfterTooLong(t *testing.T) {
+	s, ts := mockserver.Start()
+	defer ts.Close()
+	s.Script(mockserver.Fault{Status: http.StatusServiceUnavailable, RetryAfter: "86400"})
+
+	c := testClient(t, ts.URL, deviceregister.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second}))
+	start := time.Now()
+	_, err := c.Register(context.Background(), testDevice())
+
+	var se *deviceregister.StatusError
+	if !errors.As(err, &se) || se.RetryAfter != 86400*time.Second {
+		t.Fatalf("Register error = %v, want the 503 with its Retry-After", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Register returned after %v, want it to give up at once", d)
+	}
+	if n := s.Requests(); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+}
+
+func TestRegisterRetriesClientTimeout(t *testing.T) {
+	s, ts := mockserver.Start()
+	defer ts.Close()
+	s.Script(mockserver.Fault{Latency: time.Second})
+
+	c := testClient(t, ts.URL,
+		deviceregister.WithTimeout(100*time.Millisecond),
+		deviceregister.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+	res, err := c.Register(context.Background(), testDevice())
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if res.DeviceId == 0 {
+		t.Errorf("Register returned empty device_id: %+v", res)
+	}
+	if n := s.Requests(); n != 2 {
+		t.Errorf("server got %d requests, want 2", n)
+	}
+}
+
+func TestRegisterRetryAfter(t *testing.T) {
+	s, ts := mockserver.Start()
+	defer ts.Close()
+	s.Script(mockserver.Fault{Status: http.StatusServiceUnavailable, RetryAfter: "1"})
+
+	c := testClient(t, ts.URL, deviceregister.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+	start := time.Now()
+	if _, err := c.Register(context.Background(), testDevice()); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("Register returned after %v, want at least the 1s Retry-After", d)
+	}
+}
+
+func TestRegisterStopsOnCallerDeadline(t *testing.T) {
+	s, ts := mockserver.Start()
+	defer ts.Close()
+	for i := 0; i < 5; i++ {
+		s.Script(mockserver.Fault{Latency: time.Second})
+	}
+
+	c := testClient(t, ts.URL, deviceregister.WithRetryPolicy(deviceregister.RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond}))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := c.Register(ctx, testDevice())
+	if err == nil {
+		t.Fatal("Register succeeded, want the caller deadline error")
+	}
+	if n := s.Requests(); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+}
@@ -0,0 +1,154 @@
+// Package signing 实现 device_register 请求的 HMAC-SHA256 签名和校验。
+//
+// 待签名字符串为：
+//
+//	METHOD + "\n" + PATH + "\n" + TIMESTAMP + "\n" + hex(sha256(body))
+//
+// 签名为 hex(hmac_sha256(app_secret, 待签名字符串))，通过 X-App-Key、X-Timestamp、
+// X-Content-Sha256 和 X-Signature 四个请求头传递，TIMESTAMP 为 Unix 秒。
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderAppKey        = "X-App-Key"
+	HeaderTimestamp     = "X-Timestamp"
+	HeaderContentSHA256 = "X-Content-Sha256"
+	HeaderSignature     = "X-Signature"
+
+	// DefaultMaxSkew 是允许的客户端和服务端时间差
+	DefaultMaxSkew = 5 * time.Minute
+)
+
+// 可以用 errors.Is 判断的校验失败原因
+var (
+	ErrMissingSignature = errors.New("signing: missing signature headers")
+	ErrUnknownAppKey    = errors.New("signing: unknown app key")
+	ErrTimestampSkew    = errors.New("signing: timestamp out of range")
+	ErrBodyHash         = errors.New("signing: body hash mismatch")
+	ErrBadSignature     = errors.New("signing: signature mismatch")
+)
+
+// Credentials 是 app 的签名凭证，AppSecret 不能出现在日志中
+type Credentials struct {
+	AppKey    string
+	AppSecret string
+}
+
+func (c Credentials) Validate() error {
+	if c.AppKey == "" || c.AppSecret == "" {
+		return errors.New("signing: app key and app secret must both be set")
+	}
+	return nil
+}
+
+// Sign 给 req 加上签名请求头，body 必须与 req 实际发送的请求体一致
+func Sign(req *http.Request, body []byte, c Credentials, now time.Time) {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	bodyHash := hashBody(body)
+
+	req.Header.Set(HeaderAppKey, c.AppKey)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderContentSHA256, bodyHash)
+	req.Header.Set(HeaderSignature, signature(c.AppSecret, req.Method, req.URL.EscapedPath(), ts, bodyHash))
+}
+
+// Verifier 在服务端校验签名
+type Verifier struct {
+	// Secret 返回 appKey 对应的 secret，不存在时 ok 为 false
+	Secret func(appKey string) (secret string, ok bool)
+	// MaxSkew 为 0 时使用 DefaultMaxSkew
+	MaxSkew time.Duration
+}
+
+// NewVerifier 使用固定的凭证列表
+func NewVerifier(creds ...Credentials) *Verifier {
+	secrets := make(map[string]string, len(creds))
+	for _, c := range creds {
+		secrets[c.AppKey] = c.AppSecret
+	}
+
+	return &Verifier{Secret: func(appKey string) (string, bool) {
+		s, ok := secrets[appKey]
+		return s, ok
+	}}
+}
+
+// Verify 校验 r 的签名，body 是已经读出的请求体
+func (v *Verifier) Verify(r *http.Request, body []byte, now time.Time) error {
+	appKey := r.Header.Get(HeaderAppKey)
+	ts := r.Header.Get(HeaderTimestamp)
+	bodyHash := r.Header.Get(HeaderContentSHA256)
+	sig := r.Header.Get(HeaderSignature)
+	if appKey == "" || ts == "" || bodyHash == "" || sig == "" {
+		return ErrMissingSignature
+	}
+
+	secret, ok := v.Secret(appKey)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownAppKey, appKey)
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %q", ErrTimestampSkew, ts)
+	}
+	maxSkew := v.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	if skew := now.Sub(time.Unix(sec, 0)); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%w: skew %v", ErrTimestampSkew, skew.Round(time.Second))
+	}
+
+	if !hmac.Equal([]byte(bodyHash), []byte(hashBody(body))) {
+		return ErrBodyHash
+	}
+	expected := signature(secret, r.Method, r.URL.EscapedPath(), ts, bodyHash)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+// Middleware 拒绝签名不合法的请求，返回 401；通过校验的请求体会被放回 r.Body。
+// maxBody 是读取请求体的上限，超过时返回 413。
+func (v *Verifier) Middleware(maxBody int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := v.Verify(r, body, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func signature(secret, method, path, ts, bodyHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + ts + "\n" + bodyHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,161 @@
+package signing_test
+
+import (
+	"bytes"
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/gateway"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"do_some_fxxking_test/deviceregister/signing"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var creds = signing.Credentials{AppKey: "key", AppSecret: "secret"}
+
+const testBody = `{"user_unique_id":"276095447832965","app_id":10000012,"os":"ios"}`
+
+// signCase 描述一个签名请求及其被篡改的方式
+type signCase struct {
+	name  string
+	creds signing.Credentials
+	// skew 是签名时间相对当前时间的偏移
+	skew time.Duration
+	// send 不为空时替换实际发送的请求体
+	send   string
+	tamper func(h http.Header)
+	want   error
+}
+
+var signCases = []signCase{
+	{name: "valid", creds: creds},
+	{name: "missing signature", creds: creds, tamper: func(h http.Header) { h.Del(signing.HeaderSignature) }, want: signing.ErrMissingSignature},
+	{name: "missing timestamp", creds: creds, tamper: func(h http.Header) { h.Del(signing.HeaderTimestamp) }, want: signing.ErrMissingSignature},
+	{name: "missing body hash", creds: creds, tamper: func(h http.Header) { h.Del(signing.HeaderContentSHA256) }, want: signing.ErrMissingSignature},
+	{name: "unknown app key", creds: signing.Credentials{AppKey: "other", AppSecret: "secret"}, want: signing.ErrUnknownAppKey},
+	{name: "timestamp too old", creds: creds, skew: -signing.DefaultMaxSkew - time.Minute, want: signing.ErrTimestampSkew},
+	{name: "timestamp in the future", creds: creds, skew: signing.DefaultMaxSkew + time.Minute, want: signing.ErrTimestampSkew},
+	{name: "invalid timestamp", creds: creds, tamper: func(h http.Header) { h.Set(signing.HeaderTimestamp, "yesterday") }, want: signing.ErrTimestampSkew},
+	{name: "body changed", creds: creds, send: `{"user_unique_id":"1","app_id":10000012,"os":"ios"}`, want: signing.ErrBodyHash},
+	{name: "tampered signature", creds: creds, tamper: func(h http.Header) {
+		sig := []byte(h.Get(signing.HeaderSignature))
+		sig[0] ^= 1
+		h.Set(signing.HeaderSignature, string(sig))
+	}, want: signing.ErrBadSignature},
+	{name: "wrong secret", creds: signing.Credentials{AppKey: "key", AppSecret: "guess"}, want: signing.ErrBadSignature},
+}
+
+func (tt signCase) request(path string) *http.Request {
+	sent := testBody
+	if tt.send != "" {
+		sent = tt.send
+	}
+	req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(sent)))
+	signing.Sign(req, []byte(testBody), tt.creds, time.Now().Add(tt.skew))
+	if tt.tamper != nil {
+		tt.tamper(req.Header)
+	}
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	v := signing.NewVerifier(creds)
+	for _, tt := range signCases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.request("/register")
+			body, _ := ioutil.ReadAll(req.Body)
+			err := v.Verify(req, body, time.Now())
+			if tt.want == nil && err != nil || !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyPathIsSigned(t *testing.T) {
+	req := httptest.NewRequest("POST", "/register", bytes.NewReader([]byte(testBody)))
+	signing.Sign(req, []byte(testBody), creds, time.Now())
+	req.URL.Path = "/other"
+	if err := signing.NewVerifier(creds).Verify(req, []byte(testBody), time.Now()); !errors.Is(err, signing.ErrBadSignature) {
+		t.Errorf("Verify with another path = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestVerifierMaxSkew(t *testing.T) {
+	v := signing.NewVerifier(creds)
+	v.MaxSkew = time.Second
+	req := signCase{creds: creds, skew: -time.Minute}.request("/register")
+	if err := v.Verify(req, []byte(testBody), time.Now()); !errors.Is(err, signing.ErrTimestampSkew) {
+		t.Errorf("Verify = %v, want ErrTimestampSkew", err)
+	}
+}
+
+// stubRegistrar 总是注册成功
+type stubRegistrar struct{}
+
+func (stubRegistrar) Register(ctx context.Context, dr deviceregister.DeviceRegister) (*deviceregister.Response, error) {
+	return &deviceregister.Response{DeviceId: 1}, nil
+}
+
+func TestRejectedWith401(t *testing.T) {
+	v := signing.NewVerifier(creds)
+
+	mock := mockserver.New()
+	mock.Verifier = v
+	gw := gateway.New(stubRegistrar{})
+	gw.Verifier = v
+	targets := []struct {
+		name    string
+		path    string
+		handler http.Handler
+	}{
+		{"middleware", "/register", v.Middleware(1<<20, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// 通过校验的请求体被放回 r.Body
+			if body, _ := ioutil.ReadAll(r.Body); string(body) != testBody {
+				t.Errorf("next handler got body %s", body)
+			}
+		}))},
+		{"mockserver", mockserver.Path, mock},
+		{"gateway", "/register", gw},
+	}
+
+	for _, target := range targets {
+		for _, tt := range signCases {
+			if tt.want == nil {
+				continue
+			}
+			t.Run(target.name+"/"+tt.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				target.handler.ServeHTTP(w, tt.request(target.path))
+				if w.Code != http.StatusUnauthorized {
+					t.Errorf("status = %d, want 401: %s", w.Code, w.Body)
+				}
+			})
+		}
+	}
+
+	// mockserver 对签名正确但内容不完整的请求体返回 400，这里只检查另外两个
+	for _, target := range targets {
+		if target.name == "mockserver" {
+			continue
+		}
+		w := httptest.NewRecorder()
+		target.handler.ServeHTTP(w, signCases[0].request(target.path))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: signed request status = %d, want 200: %s", target.name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestMiddlewareBodyLimit(t *testing.T) {
+	h := signing.NewVerifier(creds).Middleware(8, http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, signCases[0].request("/register"))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", w.Code)
+	}
+}
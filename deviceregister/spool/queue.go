@@ -0,0 +1,629 @@
+// Package spool 是落盘的 FIFO 队列，用于网络不可用时暂存待发送的注册请求和事件。
+//
+// 每条记录先追加到 dir 下的 segment 文件，再进入内存中的环形缓冲；
+// 缓冲满后新记录只留在磁盘上，缓冲有空位时再从 segment 读回来。
+// 取出的记录在 Ack 之前不会被删除，进程重启后 Open 会重新投递所有未确认的记录，
+// 所以投递语义是至少一次，消费方需要能处理重复的记录。
+package spool
+
+import (
+	"code.byted.org/gopkg/logs"
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/eapache/queue.v1"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMemoryItems  = 1024
+	DefaultSegmentBytes = 16 << 20
+
+	// refillRetryInterval 是 ring 为空、磁盘上的记录又读不出来时 Get 重试的间隔
+	refillRetryInterval = time.Second
+)
+
+var (
+	// ErrFull 表示超过容量上限，DropNewest 时新记录被丢弃，DropOldest 时所有记录都在投递中无法腾出空间
+	ErrFull   = errors.New("spool: queue is full")
+	ErrClosed = errors.New("spool: queue is closed")
+)
+
+// DropPolicy 决定超过容量上限时丢弃哪条记录
+type DropPolicy int
+
+const (
+	// DropNewest 拒绝新记录，Put 返回 ErrFull
+	DropNewest DropPolicy = iota
+	// DropOldest 丢弃最早的未投递记录，为新记录腾出空间
+	DropOldest
+)
+
+func (p DropPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop_newest"
+	case DropOldest:
+		return "drop_oldest"
+	default:
+		return fmt.Sprintf("DropPolicy(%d)", int(p))
+	}
+}
+
+// ParseDropPolicy 解析 drop_newest 和 drop_oldest
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "drop_newest", "newest":
+		return DropNewest, nil
+	case "drop_oldest", "oldest":
+		return DropOldest, nil
+	default:
+		return 0, fmt.Errorf("spool: unknown drop policy %q, expect drop_newest or drop_oldest", s)
+	}
+}
+
+// Options 的零值字段使用默认值
+type Options struct {
+	// MemoryItems 是内存缓冲的记录数，默认 DefaultMemoryItems
+	MemoryItems int
+	// SegmentBytes 是单个 segment 文件的大小，超过后新建文件，默认 DefaultSegmentBytes
+	SegmentBytes int64
+	// MaxItems 和 MaxBytes 是未确认记录的数量和字节数上限，0 表示不限制
+	MaxItems int
+	MaxBytes int64
+	Drop     DropPolicy
+	// NoSync 为 true 时写入后不 fsync，吞吐更高，但机器掉电可能丢失最近的记录
+	NoSync bool
+}
+
+// Item 是取出的一条记录，处理完后用 ID 调用 Ack 或 Nack
+type Item struct {
+	ID   uint64
+	Data []byte
+}
+
+// Stats 是队列的当前状态和打开以来的计数
+type Stats struct {
+	// Pending 和 PendingBytes 是所有未确认的记录，包括投递中的
+	Pending      int
+	PendingBytes int64
+	InMemory     int
+	OnDisk       int
+	InFlight     int
+	Segments     int
+
+	Enqueued      int64
+	Delivered     int64
+	Acked         int64
+	Nacked        int64
+	DroppedOldest int64
+	DroppedNewest int64
+}
+
+// Queue 可以被多个 goroutine 共用，同一个 dir 同时只能被一个 Queue 打开
+type Queue struct {
+	dir  string
+	opts Options
+
+	mu     sync.Mutex
+	closed bool
+	notify chan struct{}
+
+	segments []*segment
+	w        *os.File
+	wSize    int64
+	nextSeq  uint64
+
+	// ackSeq 之前的记录都已确认，acked 是 ackSeq 之后已经确认的记录
+	ackSeq uint64
+	acked  map[uint64]bool
+
+	// redeliver 是 Nack 退回的记录，按 ID 升序，先于 ring 投递
+	redeliver []Item
+	ring      *queue.Queue
+	inflight  map[uint64][]byte
+
+	// 读游标指向第一条不在内存中的记录，rSeq 等于 nextSeq 时所有记录都在内存中
+	rSeg  *segment
+	rFile *os.File
+	rOff  int64
+	rSeq  uint64
+
+	stats Stats
+}
+
+// Open 打开 dir 中的队列，目录不存在时创建，已有的未确认记录会按顺序重新投递。
+// 进程在写入时崩溃留下的不完整记录会被截掉。
+func Open(dir string, opts Options) (*Queue, error) {
+	if opts.MemoryItems <= 0 {
+		opts.MemoryItems = DefaultMemoryItems
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = DefaultSegmentBytes
+	}
+	if opts.MaxItems < 0 || opts.MaxBytes < 0 {
+		return nil, fmt.Errorf("spool: max items and max bytes must not be negative, got %d and %d", opts.MaxItems, opts.MaxBytes)
+	}
+	if opts.Drop != DropNewest && opts.Drop != DropOldest {
+		return nil, fmt.Errorf("spool: unknown drop policy %v", opts.Drop)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("spool: create dir: %v", err)
+	}
+
+	q := &Queue{
+		dir:      dir,
+		opts:     opts,
+		notify:   make(chan struct{}, 1),
+		acked:    make(map[uint64]bool),
+		ring:     queue.New(),
+		inflight: make(map[uint64][]byte),
+	}
+	if err := q.load(); err != nil {
+		q.closeFiles()
+		return nil, fmt.Errorf("spool: open %s: %v", dir, err)
+	}
+
+	return q, nil
+}
+
+// load 扫描所有 segment，恢复未确认的记录并打开最后一个 segment 用于追加
+func (q *Queue) load() error {
+	ackSeq, err := readAck(q.dir)
+	if err != nil {
+		return err
+	}
+	q.ackSeq, q.nextSeq = ackSeq, ackSeq
+
+	segs, err := listSegments(q.dir)
+	if err != nil {
+		return err
+	}
+	if len(segs) > 0 && segs[0].first > q.ackSeq {
+		// 第一个 segment 之前的记录所在的文件已经因为全部确认被删除
+		q.ackSeq, q.nextSeq = segs[0].first, segs[0].first
+	}
+	for i, seg := range segs {
+		// 中间的 segment 被截断后留下的 seq 空洞视为已确认，否则 ackSeq 无法越过它们
+		for ; q.nextSeq < seg.first; q.nextSeq++ {
+			if q.nextSeq >= q.ackSeq {
+				q.acked[q.nextSeq] = true
+			}
+		}
+		if err := q.scan(seg, i == len(segs)-1); err != nil {
+			return err
+		}
+	}
+	q.segments = segs
+
+	if len(q.segments) == 0 {
+		if err := q.roll(); err != nil {
+			return err
+		}
+	} else {
+		last := q.segments[len(q.segments)-1]
+		if q.w, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+		fi, err := q.w.Stat()
+		if err != nil {
+			return err
+		}
+		q.wSize = fi.Size()
+	}
+	if q.rSeg == nil {
+		q.rSeg, q.rOff, q.rSeq = q.segments[len(q.segments)-1], q.wSize, q.nextSeq
+	}
+
+	return q.advance()
+}
+
+// scan 读取一个 segment，前 MemoryItems 条未确认的记录放入内存，之后的记录设置读游标
+func (q *Queue) scan(seg *segment, last bool) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var off int64
+	for expect := seg.first; ; expect++ {
+		seq, data, n, err := readRecord(f, off)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && seq != expect {
+			err = errCorrupt
+		}
+		if err == errCorrupt {
+			// 最后一个 segment 的尾部通常是崩溃时没写完的记录，中间的 segment 损坏说明磁盘有问题
+			if !last {
+				logs.Warn("spool: %s is corrupt at offset %d, dropping the rest of it", seg.path, off)
+			}
+			if err := os.Truncate(seg.path, off); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		q.nextSeq = seq + 1
+		if seq >= q.ackSeq {
+			q.stats.Pending++
+			q.stats.PendingBytes += int64(len(data))
+			if q.rSeg == nil && q.ring.Length() < q.opts.MemoryItems {
+				q.ring.Add(Item{ID: seq, Data: data})
+			} else if q.rSeg == nil {
+				q.rSeg, q.rOff, q.rSeq = seg, off, seq
+			}
+		}
+		off += n
+	}
+
+	return nil
+}
+
+// Put 追加一条记录并落盘，返回后即使进程崩溃记录也不会丢失（NoSync 时除外）
+func (q *Queue) Put(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if len(data) > maxRecordSize || q.opts.MaxBytes > 0 && int64(len(data)) > q.opts.MaxBytes {
+		q.stats.DroppedNewest++
+		return fmt.Errorf("%w: record of %d bytes is too large", ErrFull, len(data))
+	}
+	for q.overflow(len(data)) {
+		if q.opts.Drop == DropNewest || !q.dropOldest() {
+			q.stats.DroppedNewest++
+			return ErrFull
+		}
+	}
+
+	if q.wSize >= q.opts.SegmentBytes {
+		if err := q.roll(); err != nil {
+			return fmt.Errorf("spool: roll segment: %v", err)
+		}
+	}
+
+	seq := q.nextSeq
+	rec := encodeRecord(seq, data)
+	if _, err := q.w.Write(rec); err != nil {
+		// 去掉可能写了一半的记录，保证后面的记录仍然可读
+		q.w.Truncate(q.wSize)
+		return fmt.Errorf("spool: write: %v", err)
+	}
+	if !q.opts.NoSync {
+		if err := q.w.Sync(); err != nil {
+			return fmt.Errorf("spool: sync: %v", err)
+		}
+	}
+	q.wSize += int64(len(rec))
+	q.nextSeq++
+
+	// 没有积压在磁盘上的记录且内存有空位时直接进入内存，否则留在磁盘上
+	if q.rSeq == seq && q.ring.Length() < q.opts.MemoryItems {
+		q.ring.Add(Item{ID: seq, Data: append([]byte(nil), data...)})
+		q.rSeg, q.rOff, q.rSeq = q.segments[len(q.segments)-1], q.wSize, q.nextSeq
+	}
+	q.stats.Pending++
+	q.stats.PendingBytes += int64(len(data))
+	q.stats.Enqueued++
+	q.signal()
+
+	return nil
+}
+
+// Get 取出最早的一条记录，队列为空时等待直到有新记录、ctx 结束或队列关闭
+func (q *Queue) Get(ctx context.Context) (Item, error) {
+	for {
+		item, ok, err := q.TryGet()
+		if ok || err != nil {
+			return item, err
+		}
+
+		// 磁盘上还有积压说明刚才补充失败了，不能只等新的 Put 来唤醒
+		var retry *time.Timer
+		var retryC <-chan time.Time
+		if q.backlogged() {
+			retry = time.NewTimer(refillRetryInterval)
+			retryC = retry.C
+		}
+
+		select {
+		case <-q.notify:
+		case <-retryC:
+		case <-ctx.Done():
+		}
+		if retry != nil {
+			retry.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return Item{}, err
+		}
+	}
+}
+
+// backlogged 返回是否有记录还在磁盘上没有读回 ring
+func (q *Queue) backlogged() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.rSeq < q.nextSeq
+}
+
+// TryGet 取出最早的一条记录，队列为空时立即返回 false
+func (q *Queue) TryGet() (Item, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return Item{}, false, ErrClosed
+	}
+
+	item, ok, err := q.next()
+	if err != nil || !ok {
+		return Item{}, false, err
+	}
+	q.inflight[item.ID] = item.Data
+	q.stats.Delivered++
+	if len(q.redeliver) > 0 || q.ring.Length() > 0 {
+		// 唤醒其他等待中的 Get
+		q.signal()
+	}
+
+	return item, true, nil
+}
+
+// Ack 确认记录已处理，之后它不会再被投递
+func (q *Queue) Ack(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, ok := q.inflight[id]
+	if !ok {
+		return fmt.Errorf("spool: item %d is not in flight", id)
+	}
+	delete(q.inflight, id)
+	q.stats.Pending--
+	q.stats.PendingBytes -= int64(len(data))
+	q.stats.Acked++
+
+	return q.markAcked(id)
+}
+
+// Nack 把记录放回队首，下一次 Get 会再次取到它
+func (q *Queue) Nack(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, ok := q.inflight[id]
+	if !ok {
+		return fmt.Errorf("spool: item %d is not in flight", id)
+	}
+	delete(q.inflight, id)
+
+	i := sort.Search(len(q.redeliver), func(i int) bool { return q.redeliver[i].ID > id })
+	q.redeliver = append(q.redeliver, Item{})
+	copy(q.redeliver[i+1:], q.redeliver[i:])
+	q.redeliver[i] = Item{ID: id, Data: data}
+	q.stats.Nacked++
+	q.signal()
+
+	return nil
+}
+
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s := q.stats
+	s.InMemory = len(q.redeliver) + q.ring.Length()
+	s.InFlight = len(q.inflight)
+	s.OnDisk = s.Pending - s.InMemory - s.InFlight
+	s.Segments = len(q.segments)
+	return s
+}
+
+// Close 关闭文件，投递中但没有 Ack 的记录在下次 Open 时重新投递
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.notify)
+
+	return q.closeFiles()
+}
+
+func (q *Queue) closeFiles() error {
+	var err error
+	if q.w != nil {
+		err = q.w.Close()
+	}
+	if q.rFile != nil {
+		q.rFile.Close()
+	}
+	return err
+}
+
+func (q *Queue) signal() {
+	if q.closed {
+		return
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) overflow(size int) bool {
+	return q.opts.MaxItems > 0 && q.stats.Pending+1 > q.opts.MaxItems ||
+		q.opts.MaxBytes > 0 && q.stats.PendingBytes+int64(size) > q.opts.MaxBytes
+}
+
+// next 按 redeliver、ring 的顺序取出下一条记录，并从磁盘补充 ring
+func (q *Queue) next() (Item, bool, error) {
+	if len(q.redeliver) > 0 {
+		item := q.redeliver[0]
+		q.redeliver = q.redeliver[1:]
+		return item, true, nil
+	}
+	if q.ring.Length() == 0 {
+		// 上次补充失败时 ring 可能已经空了，但磁盘上还有记录，先重试一次
+		q.tryRefill()
+		if q.ring.Length() == 0 {
+			return Item{}, false, nil
+		}
+	}
+
+	item := q.ring.Remove().(Item)
+	q.tryRefill()
+	return item, true, nil
+}
+
+// tryRefill 调用 refill，读磁盘失败时只记日志，剩下的记录等下次取出时再读
+func (q *Queue) tryRefill() {
+	if err := q.refill(); err != nil {
+		logs.Error("spool: refill from %s: %v", q.rSeg.path, err)
+	}
+}
+
+// refill 从读游标开始把磁盘上的记录读回 ring，直到 ring 满或没有积压的记录
+func (q *Queue) refill() error {
+	for q.rSeq < q.nextSeq && q.ring.Length() < q.opts.MemoryItems {
+		if q.rFile == nil {
+			f, err := os.Open(q.rSeg.path)
+			if err != nil {
+				return err
+			}
+			q.rFile = f
+		}
+
+		seq, data, n, err := readRecord(q.rFile, q.rOff)
+		if err == io.EOF {
+			if !q.nextSegment() {
+				return fmt.Errorf("missing records %d to %d", q.rSeq, q.nextSeq-1)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		q.rOff += n
+		q.rSeq = seq + 1
+		if seq >= q.ackSeq && !q.acked[seq] {
+			q.ring.Add(Item{ID: seq, Data: data})
+		}
+	}
+
+	return nil
+}
+
+// nextSegment 把读游标移到下一个 segment 的开头
+func (q *Queue) nextSegment() bool {
+	for i, seg := range q.segments {
+		if seg == q.rSeg && i+1 < len(q.segments) {
+			if q.rFile != nil {
+				q.rFile.Close()
+				q.rFile = nil
+			}
+			q.rSeg, q.rOff = q.segments[i+1], 0
+			return true
+		}
+	}
+	return false
+}
+
+// dropOldest 丢弃最早的一条未投递记录，所有记录都在投递中时返回 false
+func (q *Queue) dropOldest() bool {
+	item, ok, err := q.next()
+	if err != nil || !ok {
+		return false
+	}
+
+	q.stats.Pending--
+	q.stats.PendingBytes -= int64(len(item.Data))
+	q.stats.DroppedOldest++
+	if err := q.markAcked(item.ID); err != nil {
+		logs.Error("spool: persist ack: %v", err)
+	}
+	return true
+}
+
+func (q *Queue) markAcked(id uint64) error {
+	q.acked[id] = true
+	return q.advance()
+}
+
+// advance 推进 ackSeq 并持久化，删除已经全部确认的 segment
+func (q *Queue) advance() error {
+	advanced := false
+	for q.acked[q.ackSeq] {
+		delete(q.acked, q.ackSeq)
+		q.ackSeq++
+		advanced = true
+	}
+	if !advanced {
+		return nil
+	}
+
+	if err := writeAck(q.dir, q.ackSeq, !q.opts.NoSync); err != nil {
+		return fmt.Errorf("spool: write ack: %v", err)
+	}
+	q.removeAcked()
+	return nil
+}
+
+// removeAcked 删除除最后一个之外、记录都已确认的 segment
+func (q *Queue) removeAcked() {
+	for len(q.segments) > 1 && q.segments[1].first <= q.ackSeq {
+		seg := q.segments[0]
+		if q.rSeg == seg {
+			// 读游标在这个 segment 的末尾，ackSeq 不会超过读游标
+			q.nextSegment()
+		}
+		if err := os.Remove(seg.path); err != nil {
+			logs.Warn("spool: remove %s: %v", seg.path, err)
+		}
+		q.segments = q.segments[1:]
+	}
+}
+
+// roll 新建一个 segment 用于追加
+func (q *Queue) roll() error {
+	seg := &segment{path: segmentPath(q.dir, q.nextSeq), first: q.nextSeq}
+	f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if q.w != nil {
+		q.w.Close()
+	}
+
+	atEnd := q.rSeq == q.nextSeq
+	q.segments = append(q.segments, seg)
+	q.w, q.wSize = f, 0
+	if atEnd && q.rSeg != nil {
+		q.rSeg, q.rOff = seg, 0
+		if q.rFile != nil {
+			q.rFile.Close()
+			q.rFile = nil
+		}
+	}
+
+	return nil
+}
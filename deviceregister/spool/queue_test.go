@@ -0,0 +1,324 @@
+package spool_test
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister/spool"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func open(t *testing.T, dir string, opts spool.Options) *spool.Queue {
+	t.Helper()
+
+	q, err := spool.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func put(t *testing.T, q *spool.Queue, from, to int) {
+	t.Helper()
+
+	for i := from; i <= to; i++ {
+		if err := q.Put([]byte(fmt.Sprintf("item-%d", i))); err != nil {
+			t.Fatalf("Put(item-%d): %v", i, err)
+		}
+	}
+}
+
+// get 取出 n 条记录，不 Ack
+func get(t *testing.T, q *spool.Queue, n int) []spool.Item {
+	t.Helper()
+
+	items := make([]spool.Item, 0, n)
+	for i := 0; i < n; i++ {
+		item, ok, err := q.TryGet()
+		if err != nil || !ok {
+			t.Fatalf("TryGet %d = %v, %v, want an item", i, ok, err)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// drain 取出并 Ack 所有记录，返回它们的内容
+func drain(t *testing.T, q *spool.Queue) []string {
+	t.Helper()
+
+	var data []string
+	for {
+		item, ok, err := q.TryGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return data
+		}
+		data = append(data, string(item.Data))
+		if err := q.Ack(item.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expect(t *testing.T, got []string, from, to int) {
+	t.Helper()
+
+	var want []string
+	for i := from; i <= to; i++ {
+		want = append(want, fmt.Sprintf("item-%d", i))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("items = %v, want %v", got, want)
+	}
+}
+
+func TestQueueSpillsToDisk(t *testing.T) {
+	q := open(t, tempDir(t), spool.Options{MemoryItems: 2, SegmentBytes: 64, NoSync: true})
+	put(t, q, 1, 10)
+
+	s := q.Stats()
+	if s.Pending != 10 || s.InMemory != 2 || s.OnDisk != 8 || s.Segments < 2 {
+		t.Fatalf("Stats = %+v, want 10 pending with 2 in memory over several segments", s)
+	}
+	expect(t, drain(t, q), 1, 10)
+	if s := q.Stats(); s.Pending != 0 || s.Acked != 10 || s.Segments != 1 {
+		t.Errorf("Stats = %+v, want everything acked and old segments removed", s)
+	}
+}
+
+func TestQueueReopen(t *testing.T) {
+	dir := tempDir(t)
+	opts := spool.Options{MemoryItems: 2, SegmentBytes: 64}
+
+	q, err := spool.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, q, 1, 5)
+	items := get(t, q, 2)
+	if err := q.Ack(items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	// item-2 投递中但没有 Ack，关闭后重新投递
+	q.Close()
+
+	q = open(t, dir, opts)
+	if s := q.Stats(); s.Pending != 4 {
+		t.Errorf("reopened Stats = %+v, want 4 pending", s)
+	}
+	expect(t, drain(t, q), 2, 5)
+	put(t, q, 6, 6)
+	expect(t, drain(t, q), 6, 6)
+}
+
+func TestQueueReopenAfterOutOfOrderAck(t *testing.T) {
+	dir := tempDir(t)
+	q, err := spool.Open(dir, spool.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, q, 1, 3)
+	items := get(t, q, 2)
+	if err := q.Ack(items[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// 至少投递一次：item-1 一定重新投递，乱序确认的 item-2 可能重复
+	q = open(t, dir, spool.Options{})
+	got := drain(t, q)
+	if len(got) == 0 || got[0] != "item-1" || got[len(got)-1] != "item-3" {
+		t.Errorf("items = %v, want item-1 first and item-3 last", got)
+	}
+}
+
+func TestQueueNack(t *testing.T) {
+	q := open(t, tempDir(t), spool.Options{NoSync: true})
+	put(t, q, 1, 3)
+
+	items := get(t, q, 2)
+	// 按 ID 顺序放回队首，与 Nack 的顺序无关
+	for _, i := range []int{1, 0} {
+		if err := q.Nack(items[i].ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Nack(items[0].ID); err == nil {
+		t.Error("Nack of an item not in flight succeeded")
+	}
+	expect(t, drain(t, q), 1, 3)
+	if s := q.Stats(); s.Nacked != 2 || s.Delivered != 5 {
+		t.Errorf("Stats = %+v, want 2 nacked and 5 delivered", s)
+	}
+}
+
+func TestQueueDropPolicy(t *testing.T) {
+	tests := []struct {
+		drop     spool.DropPolicy
+		from, to int
+		err      error
+	}{
+		{spool.DropNewest, 1, 3, spool.ErrFull},
+		{spool.DropOldest, 3, 5, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.drop.String(), func(t *testing.T) {
+			q := open(t, tempDir(t), spool.Options{MaxItems: 3, Drop: tt.drop, NoSync: true})
+			put(t, q, 1, 3)
+			for i := 4; i <= 5; i++ {
+				if err := q.Put([]byte(fmt.Sprintf("item-%d", i))); !errors.Is(err, tt.err) {
+					t.Fatalf("Put(item-%d) = %v, want %v", i, err, tt.err)
+				}
+			}
+			expect(t, drain(t, q), tt.from, tt.to)
+
+			s := q.Stats()
+			if tt.drop == spool.DropNewest && s.DroppedNewest != 2 || tt.drop == spool.DropOldest && s.DroppedOldest != 2 {
+				t.Errorf("Stats = %+v, want 2 dropped", s)
+			}
+		})
+	}
+}
+
+func TestQueueTruncatesCorruptTail(t *testing.T) {
+	dir := tempDir(t)
+	q, err := spool.Open(dir, spool.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, q, 1, 3)
+	q.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	sort.Strings(segments)
+	if len(segments) == 0 {
+		t.Fatal("no segment files")
+	}
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 模拟写到一半时进程退出
+	f.Write([]byte{0, 0, 0, 9, 1, 2, 3})
+	f.Close()
+
+	q = open(t, dir, spool.Options{})
+	put(t, q, 4, 4)
+	expect(t, drain(t, q), 1, 4)
+}
+
+func TestQueueGetWaits(t *testing.T) {
+	q := open(t, tempDir(t), spool.Options{NoSync: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Get(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Get on empty queue = %v, want DeadlineExceeded", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Put([]byte("item-1"))
+	}()
+	item, err := q.Get(context.Background())
+	if err != nil || string(item.Data) != "item-1" {
+		t.Fatalf("Get = %q, %v, want item-1", item.Data, err)
+	}
+
+	q.Close()
+	if _, err := q.Get(context.Background()); err != spool.ErrClosed {
+		t.Errorf("Get after Close = %v, want ErrClosed", err)
+	}
+}
+
+// hideSegment 让唯一的 segment 暂时读不到，返回恢复它的函数
+func hideSegment(t *testing.T, dir string) func() {
+	t.Helper()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segments) != 1 {
+		t.Fatalf("segments = %v, want one", segments)
+	}
+	hidden := segments[0] + ".hidden"
+	if err := os.Rename(segments[0], hidden); err != nil {
+		t.Fatal(err)
+	}
+	return func() { os.Rename(hidden, segments[0]) }
+}
+
+func TestQueueTryGetRetriesFailedRefill(t *testing.T) {
+	dir := tempDir(t)
+	q := open(t, dir, spool.Options{MemoryItems: 1, NoSync: true})
+	put(t, q, 1, 3)
+
+	// 取出 ring 中唯一的记录后补充失败，剩下的记录仍然在磁盘上
+	restore := hideSegment(t, dir)
+	q.Ack(get(t, q, 1)[0].ID)
+	if _, ok, err := q.TryGet(); ok || err != nil {
+		t.Fatalf("TryGet = %v, %v, want nothing while the segment is unreadable", ok, err)
+	}
+
+	restore()
+	expect(t, drain(t, q), 2, 3)
+}
+
+func TestQueueGetRetriesFailedRefill(t *testing.T) {
+	dir := tempDir(t)
+	q := open(t, dir, spool.Options{MemoryItems: 1, NoSync: true})
+	put(t, q, 1, 2)
+
+	restore := hideSegment(t, dir)
+	q.Ack(get(t, q, 1)[0].ID)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		restore()
+	}()
+
+	// 没有新的 Put 唤醒，Get 也要定时重试
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	item, err := q.Get(ctx)
+	if err != nil || string(item.Data) != "item-2" {
+		t.Fatalf("Get = %q, %v, want item-2 once the segment is readable again", item.Data, err)
+	}
+}
+
+func TestParseDropPolicy(t *testing.T) {
+	tests := []struct {
+		s    string
+		want spool.DropPolicy
+		ok   bool
+	}{
+		{"drop_newest", spool.DropNewest, true},
+		{"drop_oldest", spool.DropOldest, true},
+		{" Oldest ", spool.DropOldest, true},
+		{"newest", spool.DropNewest, true},
+		{"latest", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := spool.ParseDropPolicy(tt.s)
+		if (err == nil) != tt.ok || tt.ok && got != tt.want {
+			t.Errorf("ParseDropPolicy(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
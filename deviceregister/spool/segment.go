@@ -0,0 +1,147 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 记录的格式为 4 字节长度、4 字节 CRC32（覆盖 seq 和内容）、8 字节 seq，之后是内容，整数都是大端
+const (
+	recordHeaderSize = 16
+	// maxRecordSize 用于识别损坏的长度字段
+	maxRecordSize = 64 << 20
+
+	segmentSuffix = ".seg"
+	ackFile       = "ack"
+)
+
+var (
+	errCorrupt = errors.New("corrupt record")
+	crcTable   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// segment 是一个按 seq 递增追加记录的文件，文件名是第一条记录的 seq
+type segment struct {
+	path  string
+	first uint64
+}
+
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", first, segmentSuffix))
+}
+
+// listSegments 返回 dir 中的所有 segment，按 first 升序
+func listSegments(dir string) ([]*segment, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []*segment
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, &segment{path: filepath.Join(dir, name), first: first})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].first < segs[j].first })
+
+	return segs, nil
+}
+
+func encodeRecord(seq uint64, data []byte) []byte {
+	b := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(b[8:16], seq)
+	copy(b[recordHeaderSize:], data)
+	binary.BigEndian.PutUint32(b[4:8], crc32.Checksum(b[8:], crcTable))
+	return b
+}
+
+// readRecord 读取 off 处的一条记录，n 是记录占用的字节数。
+// 正好在文件末尾时返回 io.EOF，记录不完整或校验失败时返回 errCorrupt。
+func readRecord(f *os.File, off int64) (seq uint64, data []byte, n int64, err error) {
+	var h [recordHeaderSize]byte
+	if _, err := f.ReadAt(h[:], off); err != nil {
+		if err == io.EOF {
+			if fi, serr := f.Stat(); serr == nil && fi.Size() == off {
+				return 0, nil, 0, io.EOF
+			}
+			return 0, nil, 0, errCorrupt
+		}
+		return 0, nil, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(h[0:4])
+	if size > maxRecordSize {
+		return 0, nil, 0, errCorrupt
+	}
+	b := make([]byte, 8+int(size))
+	copy(b, h[8:16])
+	if _, err := f.ReadAt(b[8:], off+recordHeaderSize); err != nil {
+		if err == io.EOF {
+			return 0, nil, 0, errCorrupt
+		}
+		return 0, nil, 0, err
+	}
+	if crc32.Checksum(b, crcTable) != binary.BigEndian.Uint32(h[4:8]) {
+		return 0, nil, 0, errCorrupt
+	}
+
+	return binary.BigEndian.Uint64(b[0:8]), b[8:], recordHeaderSize + int64(size), nil
+}
+
+// readAck 返回持久化的确认位置，seq 小于它的记录都已确认，文件不存在时为 0
+func readAck(dir string) (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, ackFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("corrupt ack file: %v", err)
+	}
+	return seq, nil
+}
+
+// writeAck 先写临时文件再 rename，进程崩溃时 ack 文件要么是旧值要么是新值
+func writeAck(dir string, seq uint64, sync bool) error {
+	tmp := filepath.Join(dir, ackFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strconv.FormatUint(seq, 10) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, ackFile))
+}
@@ -0,0 +1,223 @@
+package deviceregister
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TLSConfig 是访问 https endpoint 的配置，字段都是可选的
+type TLSConfig struct {
+	// CAFile 是 PEM 格式的 CA 证书，用于私有 CA 签发的服务端证书，为空时使用系统 CA
+	CAFile string `json:"ca_file"`
+	// CertFile 和 KeyFile 是 mTLS 的客户端证书和私钥，必须同时设置
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// MinVersion 为 1.0、1.1、1.2 或 1.3，默认 1.2
+	MinVersion string `json:"min_version"`
+	// ServerName 覆盖用于 SNI 和证书校验的主机名，endpoint 是 IP 时通常与 Host 相同
+	ServerName string `json:"server_name"`
+}
+
+// ProxyConfig 是出口代理的配置
+type ProxyConfig struct {
+	// URL 是代理地址，支持 http、https 和 socks5；为空时不使用任何代理，包括环境变量中的代理
+	URL string `json:"url"`
+	// NoProxy 中的目标不走代理，格式与 NO_PROXY 环境变量相同：
+	// 主机名（同时匹配子域名）、.example.com、IP、CIDR、可以带端口，* 表示全部不走代理
+	NoProxy []string `json:"no_proxy"`
+}
+
+// WithTLS 设置 https endpoint 的 TLS 配置，不能和 WithHTTPClient 同时使用
+func WithTLS(cfg TLSConfig) Option {
+	return func(c *Client) {
+		c.tls = &cfg
+	}
+}
+
+// WithProxy 设置出口代理，不能和 WithHTTPClient 同时使用。
+// 没有设置时与 http.DefaultTransport 一样读取 HTTP_PROXY、HTTPS_PROXY 和 NO_PROXY 环境变量。
+func WithProxy(cfg ProxyConfig) Option {
+	return func(c *Client) {
+		c.proxy = &cfg
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTransport 按 TLS 和代理配置构造 http.Transport，其他参数与 http.DefaultTransport 相同
+func (c *Client) newTransport() (*http.Transport, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.tls != nil {
+		hasHTTPS := false
+		for _, endpoint := range c.endpoints {
+			if strings.HasPrefix(strings.ToLower(endpoint), "https://") {
+				hasHTTPS = true
+			}
+		}
+		if !hasHTTPS {
+			return nil, errors.New("deviceregister: tls is configured but no endpoint uses https")
+		}
+
+		tc, err := c.tls.build()
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tc
+	}
+
+	if c.proxy != nil {
+		proxy, err := c.proxy.build()
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = proxy
+	}
+
+	return tr, nil
+}
+
+func (cfg TLSConfig) build() (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.ServerName}
+
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("deviceregister: unknown tls min version %q, expect 1.0, 1.1, 1.2 or 1.3", cfg.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("deviceregister: read tls ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("deviceregister: no PEM certificate found in tls ca file %s", cfg.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("deviceregister: tls cert file and key file must both be set")
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("deviceregister: load tls client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+func (cfg ProxyConfig) build() (func(*http.Request) (*url.URL, error), error) {
+	if cfg.URL == "" {
+		if len(cfg.NoProxy) > 0 {
+			return nil, errors.New("deviceregister: no_proxy is set without a proxy url")
+		}
+		// 显式关闭代理，包括环境变量中的代理
+		return nil, nil
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("deviceregister: invalid proxy url %q: %v", cfg.URL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("deviceregister: proxy url %q must use http, https or socks5", cfg.URL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("deviceregister: proxy url %q has no host", cfg.URL)
+	}
+
+	rules := make([]noProxyRule, 0, len(cfg.NoProxy))
+	for _, s := range cfg.NoProxy {
+		r, err := parseNoProxy(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		for _, r := range rules {
+			if r.match(req.URL) {
+				return nil, nil
+			}
+		}
+		return u, nil
+	}, nil
+}
+
+// noProxyRule 是 NoProxy 中的一项，all、cidr、host 只有一个生效
+type noProxyRule struct {
+	all  bool
+	cidr *net.IPNet
+	host string
+	port string
+}
+
+func parseNoProxy(s string) (noProxyRule, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch {
+	case s == "":
+		return noProxyRule{}, errors.New("deviceregister: empty no_proxy entry")
+	case s == "*":
+		return noProxyRule{all: true}, nil
+	}
+
+	if _, cidr, err := net.ParseCIDR(s); err == nil {
+		return noProxyRule{cidr: cidr}, nil
+	}
+
+	host, port := s, ""
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return noProxyRule{cidr: &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, port: port}, nil
+	}
+	if strings.ContainsAny(host, "/ ") {
+		return noProxyRule{}, fmt.Errorf("deviceregister: invalid no_proxy entry %q", s)
+	}
+
+	return noProxyRule{host: strings.TrimPrefix(host, "."), port: port}, nil
+}
+
+func (r noProxyRule) match(u *url.URL) bool {
+	if r.all {
+		return true
+	}
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+
+	if r.cidr != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.cidr.Contains(ip)
+	}
+	return host == r.host || strings.HasSuffix(host, "."+r.host)
+}
@@ -0,0 +1,148 @@
+package deviceregister
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const httpsEndpoint = "https://10.0.0.1/service/2/device_register/"
+
+func TestNewClientTransportErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"tls with http endpoints", []Option{WithEndpoints("http://a/", "http://b/"), WithTLS(TLSConfig{ServerName: "a"})}, "no endpoint uses https"},
+		{"cert without key", []Option{WithEndpoint(httpsEndpoint), WithTLS(TLSConfig{CertFile: "client.pem"})}, "cert file and key file must both be set"},
+		{"key without cert", []Option{WithEndpoint(httpsEndpoint), WithTLS(TLSConfig{KeyFile: "client.key"})}, "cert file and key file must both be set"},
+		{"missing cert files", []Option{WithEndpoint(httpsEndpoint), WithTLS(TLSConfig{CertFile: filepath.Join(dir, "c.pem"), KeyFile: filepath.Join(dir, "c.key")})}, "load tls client certificate"},
+		{"min version", []Option{WithEndpoint(httpsEndpoint), WithTLS(TLSConfig{MinVersion: "1.4"})}, "unknown tls min version"},
+		{"missing ca file", []Option{WithEndpoint(httpsEndpoint), WithTLS(TLSConfig{CAFile: filepath.Join(dir, "missing.pem")})}, "read tls ca file"},
+		{"ca file without pem", []Option{WithEndpoint(httpsEndpoint), WithTLS(TLSConfig{CAFile: notPEM})}, "no PEM certificate"},
+		{"no_proxy without proxy", []Option{WithProxy(ProxyConfig{NoProxy: []string{"10.0.0.0/8"}})}, "no_proxy is set without a proxy url"},
+		{"proxy scheme", []Option{WithProxy(ProxyConfig{URL: "ftp://proxy:21"})}, "must use http, https or socks5"},
+		{"proxy without scheme", []Option{WithProxy(ProxyConfig{URL: "proxy:3128"})}, "must use http, https or socks5"},
+		{"proxy without host", []Option{WithProxy(ProxyConfig{URL: "http://"})}, "has no host"},
+		{"proxy not a url", []Option{WithProxy(ProxyConfig{URL: "http://[::1"})}, "invalid proxy url"},
+		{"empty no_proxy entry", []Option{WithProxy(ProxyConfig{URL: "http://proxy:3128", NoProxy: []string{" "}})}, "empty no_proxy entry"},
+		{"bad no_proxy entry", []Option{WithProxy(ProxyConfig{URL: "http://proxy:3128", NoProxy: []string{"a b"}})}, "invalid no_proxy entry"},
+		{"with http client", []Option{WithHTTPClient(http.DefaultClient), WithProxy(ProxyConfig{})}, "cannot be used with WithHTTPClient"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(tt.opts...)
+			if err == nil {
+				c.Close()
+				t.Fatalf("NewClient succeeded, want an error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("NewClient error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSConfigBuild(t *testing.T) {
+	tc, err := TLSConfig{MinVersion: "1.3", ServerName: "snssdk.vpc.com"}.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.MinVersion != tls.VersionTLS13 || tc.ServerName != "snssdk.vpc.com" {
+		t.Errorf("tls config = min %x server name %q", tc.MinVersion, tc.ServerName)
+	}
+
+	if tc, err := (TLSConfig{}).build(); err != nil || tc.MinVersion != tls.VersionTLS12 || tc.RootCAs != nil {
+		t.Errorf("default tls config = %+v, %v, want TLS 1.2 and system CAs", tc, err)
+	}
+}
+
+func TestNoProxyMatch(t *testing.T) {
+	tests := []struct {
+		rule string
+		url  string
+		want bool
+	}{
+		{"*", "http://anything/", true},
+		{"example.com", "http://example.com/", true},
+		{"example.com", "http://api.example.com/", true},
+		{"example.com", "http://EXAMPLE.com/", true},
+		{"example.com", "http://notexample.com/", false},
+		{".example.com", "http://api.example.com/", true},
+		{".example.com", "http://example.com/", true},
+		{"example.com:8080", "http://example.com:8080/", true},
+		{"example.com:8080", "http://example.com/", false},
+		{"example.com:443", "https://example.com/", true},
+		{"example.com:80", "https://example.com/", false},
+		{"10.0.0.0/8", "http://10.225.130.116/", true},
+		{"10.0.0.0/8", "http://11.0.0.1/", false},
+		{"10.0.0.0/8", "http://ten.example.com/", false},
+		{"10.0.0.1", "http://10.0.0.1/", true},
+		{"10.0.0.1", "http://10.0.0.2/", false},
+		{"10.0.0.1:8080", "http://10.0.0.1:8080/", true},
+		{"10.0.0.1:8080", "http://10.0.0.1/", false},
+		{"fd00::/8", "http://[fd00::1]/", true},
+		{"::1", "http://[::1]:8080/", true},
+	}
+	for _, tt := range tests {
+		r, err := parseNoProxy(tt.rule)
+		if err != nil {
+			t.Errorf("parseNoProxy(%q): %v", tt.rule, err)
+			continue
+		}
+		u, _ := url.Parse(tt.url)
+		if got := r.match(u); got != tt.want {
+			t.Errorf("rule %q match %s = %v, want %v", tt.rule, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestProxyConfigBuild(t *testing.T) {
+	proxy, err := ProxyConfig{URL: "socks5://proxy:1080", NoProxy: []string{"10.0.0.0/8", ".internal"}}.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url   string
+		proxy string
+	}{
+		{"http://10.0.0.1/", ""},
+		{"http://api.internal/", ""},
+		{"https://example.com/", "socks5://proxy:1080"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", tt.url, nil)
+		u, err := proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != tt.proxy {
+			t.Errorf("proxy for %s = %q, want %q", tt.url, got, tt.proxy)
+		}
+	}
+
+	// 空的 URL 显式关闭代理，不读取环境变量
+	if proxy, err := (ProxyConfig{}).build(); err != nil || proxy != nil {
+		t.Errorf("empty proxy config = %v, %v, want no proxy func", proxy != nil, err)
+	}
+}
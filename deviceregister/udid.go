@@ -0,0 +1,51 @@
+package deviceregister
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"strconv"
+	"strings"
+)
+
+// WithDeterministicUDID 让 vendor_id/openudid 由 namespace、AppId 和 UserUniqueId 推导，
+// 同一个用户重复注册时发送相同的标识，不会生成新设备。
+// namespace 相当于密钥，不同部署应该使用不同的值，且不能为空。
+// 默认每次注册都随机生成标识。
+func WithDeterministicUDID(namespace string) Option {
+	return func(c *Client) {
+		c.deterministicUDID = true
+		c.udidNamespace = namespace
+	}
+}
+
+// DeriveUDID 按 UUID v5 的方式计算标识：
+// 先用 SHA-1("deviceregister:" + namespace) 的前 16 字节作为命名空间，
+// 再对 "app_id:user_unique_id" 做 v5 哈希，返回大写的标准格式。
+func DeriveUDID(namespace string, appId uint32, userUniqueId string) string {
+	ns := sha1.Sum([]byte("deviceregister:" + namespace))
+
+	h := sha1.New()
+	h.Write(ns[:16])
+	h.Write([]byte(strconv.FormatUint(uint64(appId), 10) + ":" + userUniqueId))
+	sum := h.Sum(nil)
+
+	u := sum[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]))
+}
+
+// udid 返回本次注册使用的 vendor_id/openudid
+func (c *Client) udid(dr DeviceRegister) (string, error) {
+	if c.deterministicUDID {
+		return DeriveUDID(c.udidNamespace, dr.AppId, dr.UserUniqueId), nil
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(id), nil
+}
@@ -0,0 +1,62 @@
+package deviceregister_test
+
+import (
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeriveUDID(t *testing.T) {
+	tests := []struct {
+		namespace    string
+		appId        uint32
+		userUniqueId string
+		want         string
+	}{
+		{"prod", 10000012, "276095447832965", "D931B70D-87A9-5BA6-8E07-A87D7734D880"},
+		{"staging", 10000012, "276095447832965", "5C5A88D6-4201-5222-A5FA-6A45CA2B2648"},
+		{"prod", 10000013, "276095447832965", "40642378-C56D-51FB-A075-ABFE27B63236"},
+		{"prod", 10000012, "u1", "D5E11C50-3C43-55D7-9CFF-B9823C537D48"},
+		// app_id 和 user_unique_id 之间的分隔符不能让不同的组合得到相同的结果
+		{"prod", 1, "2:3", "4F93AC7F-C0CD-5286-9731-716F1682D68E"},
+		{"prod", 12, ":3", "5DD66D02-A7F0-5CD5-A724-1515822EA561"},
+	}
+	for _, tt := range tests {
+		if got := deviceregister.DeriveUDID(tt.namespace, tt.appId, tt.userUniqueId); got != tt.want {
+			t.Errorf("DeriveUDID(%q, %d, %q) = %s, want %s", tt.namespace, tt.appId, tt.userUniqueId, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterDeterministicUDID(t *testing.T) {
+	rec := &bodyRecorder{next: mockserver.New()}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	c := testClient(t, ts.URL, deviceregister.WithDeterministicUDID("prod"))
+	dr := testDevice()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Register(context.Background(), dr); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+	}
+
+	if len(rec.bodies) != 2 {
+		t.Fatalf("server got %d requests, want 2", len(rec.bodies))
+	}
+	want := deviceregister.DeriveUDID("prod", dr.AppId, dr.UserUniqueId)
+	for i, b := range rec.bodies {
+		var body struct {
+			Header map[string]interface{} `json:"header"`
+		}
+		if err := json.Unmarshal(b, &body); err != nil {
+			t.Fatal(err)
+		}
+		if got := body.Header["vendor_id"]; got != want {
+			t.Errorf("request %d vendor_id = %v, want %s", i, got, want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	code.byted.org/gopkg/logs v1.1.12
+	code.byted.org/gopkg/metrics v1.4.5
 	github.com/hashicorp/go-uuid v1.0.2
 	gopkg.in/eapache/queue.v1 v1.1.0
 )
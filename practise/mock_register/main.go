@@ -0,0 +1,46 @@
+package main
+
+import (
+	"code.byted.org/gopkg/logs"
+	"do_some_fxxking_test/deviceregister/mockserver"
+	"do_some_fxxking_test/deviceregister/signing"
+	"flag"
+	"net/http"
+	"os"
+)
+
+// 本地启动一个 device_register 和 app_log 的 mock，例如：
+//
+//	mock_register -addr 127.0.0.1:8080
+//	test_http -endpoint http://127.0.0.1:8080/service/2/device_register/?fault=503
+//
+// 设置 -app-key 和环境变量 MOCK_REGISTER_APP_SECRET 后要求请求签名。
+func main() {
+	defer logs.Stop()
+
+	addr := flag.String("addr", "127.0.0.1:8080", "listen address")
+	appKey := flag.String("app-key", "", "require requests signed with this app key and $MOCK_REGISTER_APP_SECRET")
+	flag.Parse()
+
+	s := mockserver.New()
+	c := mockserver.NewCollector()
+	if *appKey != "" {
+		creds := signing.Credentials{AppKey: *appKey, AppSecret: os.Getenv("MOCK_REGISTER_APP_SECRET")}
+		if err := creds.Validate(); err != nil {
+			logs.Error("%v", err)
+			return
+		}
+		s.Verifier = signing.NewVerifier(creds)
+		c.Verifier = s.Verifier
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(mockserver.Path, s)
+	mux.Handle(mockserver.AppLogPath, c)
+
+	logs.Info("mock device_register listening on http://%s%s", *addr, mockserver.Path)
+	logs.Info("mock app_log listening on http://%s%s", *addr, mockserver.AppLogPath)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		logs.Error("listen err: %v", err)
+	}
+}
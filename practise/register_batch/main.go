@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"code.byted.org/gopkg/logs"
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/batch"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 批量注册 device_id，例如：
+//
+//	register_batch -input users.csv -output result.jsonl -workers 8 -qps 50 -checkpoint users.ckpt
+//
+// 中断后加上 -resume 重跑，已经成功的用户会被跳过，失败的和中断时正在注册的用户会重新发送。
+// 使用 -checkpoint 时必须配置 udid_namespace，重新发送的请求与第一次的 udid 相同，不会注册出重复的设备。
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	defer logs.Stop()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	var (
+		input        = fs.String("input", "-", "input file, - for stdin")
+		inputFormat  = fs.String("input-format", "", "csv or jsonl, guessed from -input extension by default")
+		output       = fs.String("output", "-", "result file, - for stdout")
+		outputFormat = fs.String("output-format", "", "csv or jsonl, guessed from -output extension by default")
+		workers      = fs.Int("workers", 4, "concurrent workers")
+		qps          = fs.Float64("qps", 0, "global request rate limit, 0 for unlimited")
+		checkpoint   = fs.String("checkpoint", "", "journal of finished rows, required by -resume")
+		resume       = fs.Bool("resume", false, "skip rows that already succeeded in -checkpoint")
+		cacheFile    = fs.String("cache", "", "registration cache file shared across runs")
+		cacheTTL     = fs.Duration("cache-ttl", 24*time.Hour, "registration cache ttl, 0 for never expire")
+	)
+	cfg, err := deviceregister.LoadConfig(fs, os.Args[1:])
+	if err != nil {
+		logs.Error("load config err: %v", err)
+		return 2
+	}
+
+	opts := cfg.Options()
+	if *cacheFile != "" {
+		cache, err := deviceregister.OpenFileCache(*cacheFile, *cacheTTL)
+		if err != nil {
+			logs.Error("open cache err: %v", err)
+			return 2
+		}
+		defer func() {
+			if err := cache.Compact(); err != nil {
+				logs.Warn("compact cache err: %v", err)
+			}
+			stats := cache.Stats()
+			logs.Info("cache entries %d, hits %d, misses %d", stats.Entries, stats.Hits, stats.Misses)
+			cache.Close()
+		}()
+		opts = append(opts, deviceregister.WithCache(cache))
+	}
+
+	client, err := deviceregister.NewClient(opts...)
+	if err != nil {
+		logs.Error("new client err: %v", err)
+		return 2
+	}
+	defer client.Close()
+
+	var cp *batch.Checkpoint
+	if *checkpoint != "" {
+		if cfg.UDIDNamespace == "" {
+			logs.Error("-checkpoint requires udid_namespace in the config file or $%s", deviceregister.EnvUDIDNamespace)
+			return 2
+		}
+		cp, err = batch.OpenCheckpoint(*checkpoint, *resume)
+		if err != nil {
+			logs.Error("open checkpoint err: %v", err)
+			return 2
+		}
+		defer cp.Close()
+		if *resume {
+			logs.Info("resume from checkpoint: %d succeeded, %d failed", cp.Succeeded, cp.Failed)
+		}
+	} else if *resume {
+		logs.Error("-resume requires -checkpoint")
+		return 2
+	}
+
+	in, err := openInput(*input)
+	if err != nil {
+		logs.Error("open input err: %v", err)
+		return 2
+	}
+	defer in.Close()
+
+	reader, err := batch.NewReader(guessFormat(*inputFormat, *input), bufio.NewReader(in))
+	if err != nil {
+		logs.Error("new reader err: %v", err)
+		return 2
+	}
+
+	out, err := openOutput(*output)
+	if err != nil {
+		logs.Error("open output err: %v", err)
+		return 2
+	}
+	defer out.Close()
+
+	bw := bufio.NewWriter(out)
+
+	writer, err := batch.NewWriter(guessFormat(*outputFormat, *output), bw)
+	if err != nil {
+		logs.Error("new writer err: %v", err)
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		<-ch
+		cancel()
+	}()
+
+	runner := &batch.Runner{Registrar: client, Workers: *workers, QPS: *qps, Checkpoint: cp}
+	summary, err := runner.Run(ctx, reader, writer)
+	summary.Print(os.Stderr)
+	// 结果写不完整时必须返回非 0，否则调用方会以为所有结果都已经输出
+	if ferr := bw.Flush(); ferr != nil {
+		logs.Error("flush output err: %v", ferr)
+		return 1
+	}
+	if cerr := out.Close(); cerr != nil {
+		logs.Error("close output err: %v", cerr)
+		return 1
+	}
+	if err != nil {
+		logs.Error("batch err: %v", err)
+		return 1
+	}
+	if summary.Failed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func guessFormat(format, path string) string {
+	if format != "" {
+		return format
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return "csv"
+	}
+	return "jsonl"
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create %s: %v", path, err)
+	}
+	return f, nil
+}
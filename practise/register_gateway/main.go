@@ -0,0 +1,101 @@
+package main
+
+import (
+	"code.byted.org/gopkg/logs"
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/gateway"
+	"do_some_fxxking_test/deviceregister/signing"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// 以 HTTP 服务的方式提供设备注册，例如：
+//
+//	register_gateway -addr :8080 -endpoint http://10.0.0.1/service/2/device_register/
+//	curl -XPOST localhost:8080/register -H 'Idempotency-Key: k1' \
+//		-d '{"user_unique_id": "276095447832965", "app_id": 10000012, "os": "ios"}'
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	defer logs.Stop()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	var (
+		addr            = fs.String("addr", ":8080", "listen address")
+		maxBody         = fs.Int64("max-body", gateway.DefaultMaxBodyBytes, "max request body bytes")
+		idempotencyTTL  = fs.Duration("idempotency-ttl", gateway.DefaultIdempotencyTTL, "how long successful results are kept per Idempotency-Key")
+		requestTimeout  = fs.Duration("request-timeout", gateway.DefaultRequestTimeout, "timeout of one registration including retries")
+		drainDelay      = fs.Duration("drain-delay", 5*time.Second, "time between failing /readyz and closing the listener")
+		shutdownTimeout = fs.Duration("shutdown-timeout", 30*time.Second, "max time to wait for in-flight requests")
+		callerKey       = fs.String("caller-app-key", "", "require callers to sign with this app key and $REGISTER_GATEWAY_CALLER_SECRET")
+	)
+	cfg, err := deviceregister.LoadConfig(fs, os.Args[1:])
+	if err != nil {
+		logs.Error("load config err: %v", err)
+		return 2
+	}
+
+	client, err := deviceregister.NewClient(cfg.Options()...)
+	if err != nil {
+		logs.Error("new client err: %v", err)
+		return 2
+	}
+	defer client.Close()
+
+	gw := &gateway.Server{
+		Registrar:      client,
+		MaxBodyBytes:   *maxBody,
+		IdempotencyTTL: *idempotencyTTL,
+		RequestTimeout: *requestTimeout,
+	}
+	if *callerKey != "" {
+		creds := signing.Credentials{AppKey: *callerKey, AppSecret: os.Getenv("REGISTER_GATEWAY_CALLER_SECRET")}
+		if err := creds.Validate(); err != nil {
+			logs.Error("%v", err)
+			return 2
+		}
+		gw.Verifier = signing.NewVerifier(creds)
+	}
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           gw,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		logs.Info("register gateway listening on %s", *addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-errCh:
+		logs.Error("listen err: %v", err)
+		return 1
+	case s := <-sig:
+		logs.Info("received %v, draining", s)
+	}
+
+	gw.Drain()
+	time.Sleep(*drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logs.Error("shutdown err: %v", err)
+		return 1
+	}
+	logs.Info("register gateway stopped")
+
+	return 0
+}
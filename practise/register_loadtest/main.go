@@ -0,0 +1,106 @@
+package main
+
+import (
+	"code.byted.org/gopkg/logs"
+	"context"
+	"do_some_fxxking_test/deviceregister"
+	"do_some_fxxking_test/deviceregister/loadtest"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 按目标速率压测 device_register，例如 30 秒内从 10 QPS 爬升到 200 QPS，再保持 2 分钟：
+//
+//	register_loadtest -start-qps 10 -qps 200 -ramp-up 30s -duration 150s -max-attempts 1 -json run1.json
+//
+// 每次运行生成新的 user_unique_id 前缀，不会与之前的用户重复。
+// 默认会按客户端配置重试，只想看单次请求的表现时加上 -max-attempts 1。
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	defer logs.Stop()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	var (
+		qps         = fs.Float64("qps", 10, "target requests per second")
+		startQPS    = fs.Float64("start-qps", 0, "rate at the beginning of -ramp-up")
+		rampUp      = fs.Duration("ramp-up", 0, "time to ramp linearly from -start-qps to -qps")
+		duration    = fs.Duration("duration", time.Minute, "total duration including -ramp-up")
+		maxInFlight = fs.Int("max-in-flight", 1000, "max concurrent requests, requests beyond it are dropped")
+		appId       = fs.Uint("app-id", 10000012, "app_id of synthesized users")
+		oses        = fs.String("os", "ios,android", "comma separated os of synthesized users")
+		prefix      = fs.String("user-prefix", "", "user_unique_id prefix, defaults to loadtest-<unix time>-")
+		jsonOut     = fs.String("json", "", "write the report as JSON to this file")
+	)
+	cfg, err := deviceregister.LoadConfig(fs, os.Args[1:])
+	if err != nil {
+		logs.Error("load config err: %v", err)
+		return 2
+	}
+
+	client, err := deviceregister.NewClient(cfg.Options()...)
+	if err != nil {
+		logs.Error("new client err: %v", err)
+		return 2
+	}
+	defer client.Close()
+
+	if *prefix == "" {
+		*prefix = fmt.Sprintf("loadtest-%d-", time.Now().Unix())
+	}
+	runner := &loadtest.Runner{
+		Registrar: client,
+		Rate: loadtest.Rate{
+			Start:    *startQPS,
+			Target:   *qps,
+			RampUp:   *rampUp,
+			Duration: *duration,
+		},
+		Users: &loadtest.Users{
+			AppId:  uint32(*appId),
+			Oses:   strings.Split(*oses, ","),
+			Prefix: *prefix,
+		},
+		MaxInFlight: *maxInFlight,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		logs.Warn("interrupted, stopping load test")
+		cancel()
+	}()
+
+	report, err := runner.Run(ctx)
+	if err != nil {
+		logs.Error("load test err: %v", err)
+		return 2
+	}
+	report.Print(os.Stderr)
+
+	if *jsonOut != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			logs.Error("marshal report err: %v", err)
+			return 1
+		}
+		if err := ioutil.WriteFile(*jsonOut, data, 0644); err != nil {
+			logs.Error("write report err: %v", err)
+			return 1
+		}
+	}
+
+	return 0
+}